@@ -4,22 +4,74 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"emsg-daemon/internal/auth"
+	"emsg-daemon/internal/config"
+	"emsg-daemon/internal/events"
+	"emsg-daemon/internal/federation"
 	"emsg-daemon/internal/group"
 	"emsg-daemon/internal/message"
 	"emsg-daemon/internal/router"
 	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
 
 	"go.etcd.io/bbolt"
 )
 
 // BoltAPI handler struct to hold BoltDB reference
 type BoltAPI struct {
-	DB *bbolt.DB
+	DB      *bbolt.DB
+	Domains []string                 // domains delivered locally
+	Keys    federation.KeyResolver   // sender key lookup for inbound federated messages
+	Relays  federation.RelayVerifier // confirms group deliveries fanned out by other home servers
+	Admins  []string                 // addresses allowed to read any mailbox
+	Events  *events.Hub              // push notifications for connected clients
+}
+
+// StartEvents creates the event hub and publishes every message stored in the
+// database to the connected clients of its recipients, and every delivery
+// status change to the connected clients of the sender
+func (api *BoltAPI) StartEvents() {
+	api.Events = events.NewHub()
+	storage.OnMessageStored(api.DB, api.publishStored)
+	storage.OnDeliveryStatus(api.DB, api.publishDelivery)
+}
+
+// publishStored notifies each recipient of a newly stored message
+func (api *BoltAPI) publishStored(msg *message.Message, recipients []string) {
+	seqs, err := storage.InboxSequencesBolt(api.DB, msg.ID, recipients)
+	if err != nil {
+		log.Printf("inbox sequence: %v", err)
+	}
+	for _, recipient := range recipients {
+		api.Events.Publish(recipient, messageEvent(msg, seqs[recipient]))
+	}
+}
+
+// publishDelivery notifies the sender of a tracked message that its delivery status changed
+func (api *BoltAPI) publishDelivery(record *storage.DeliveryRecord, recipients []string) {
+	api.Events.Publish(record.From, events.Event{Type: events.TypeDeliveryStatus, Data: record})
+}
+
+// isAdmin reports whether address is a daemon administrator
+func (api *BoltAPI) isAdmin(address string) bool {
+	if address == "" {
+		return false
+	}
+	for _, admin := range api.Admins {
+		if admin == address {
+			return true
+		}
+	}
+	return false
 }
 
 // Example: GET /api/user?address=alice#emsg.dev
@@ -61,6 +113,10 @@ func (api *BoltAPI) ApiRegisterUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if system.IsAddress(user.Address) {
+		http.Error(w, "the system address is reserved", http.StatusBadRequest)
+		return
+	}
 	if err := storage.StoreUserBolt(api.DB, user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -82,37 +138,296 @@ func (api *BoltAPI) ApiSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Store message
-	if err := storage.StoreMessageBolt(api.DB, &msg); err != nil {
+	// Authenticated users may only send as themselves, with a valid signature
+	sender := GetAuthenticatedUser(r)
+	if msg.From != sender {
+		http.Error(w, "from does not match authenticated user", http.StatusForbidden)
+		return
+	}
+	if msg.Signature == "" {
+		http.Error(w, "missing message signature", http.StatusBadRequest)
+		return
+	}
+	if msg.ID == "" || msg.SentAt == 0 {
+		http.Error(w, "id and sent_at must be set before signing", http.StatusBadRequest)
+		return
+	}
+	if err := msg.CheckTimes(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := storage.GetUserBolt(api.DB, sender)
+	if err != nil {
+		http.Error(w, "sender not registered", http.StatusForbidden)
+		return
+	}
+	if !msg.Verify(user.PubKey) {
+		http.Error(w, "message signature verification failed", http.StatusUnauthorized)
+		return
+	}
+
+	// Group messages, and CC'd groups hosted here, go to the stored group's members,
+	// and only members with the post permission may send them. A group hosted
+	// elsewhere is delivered to its own address: its home server checks the
+	// sender and relays the message to the members.
+	groups := make(map[string]*group.Group)
+	if msg.GroupID != "" {
+		if strings.Contains(msg.GroupID, "#") {
+			if err := router.ValidateGroupID(msg.GroupID); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if api.isRemoteGroup(msg.GroupID) {
+			groups[msg.GroupID] = &group.Group{ID: msg.GroupID, Members: []string{msg.GroupID}}
+		} else {
+			grp, err := storage.GetGroupBolt(api.DB, msg.GroupID)
+			if err != nil {
+				http.Error(w, "group not found", http.StatusNotFound)
+				return
+			}
+			groups[grp.ID] = grp
+		}
+	}
+	for _, cc := range msg.CC {
+		if !router.IsLocalDomain(router.DomainOf(cc), api.Domains) {
+			continue // routed to the address's server, which expands it if it is a group
+		}
+		if grp, err := storage.GetGroupBolt(api.DB, cc); err == nil {
+			groups[grp.ID] = grp
+		}
+	}
+	for _, grp := range groups {
+		if api.isRemoteGroup(grp.ID) {
+			continue
+		}
+		if !grp.IsMember(sender) {
+			http.Error(w, fmt.Sprintf("not a member of group %s", grp.ID), http.StatusForbidden)
+			return
+		}
+		if !grp.Can(sender, group.PermPost) {
+			http.Error(w, fmt.Sprintf("not allowed to post in group %s", grp.ID), http.StatusForbidden)
+			return
+		}
+		if grp.Archived {
+			http.Error(w, fmt.Sprintf("group %s is archived", grp.ID), http.StatusForbidden)
+			return
+		}
+	}
+	recipients, err := msg.Deliver(groups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Store message in the mailboxes of local recipients
+	local, remote := router.PartitionRecipients(recipients, api.Domains)
+	if err := storage.DeliverMessageBolt(api.DB, &msg, local); err != nil {
+		if err == storage.ErrMessageExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	record, err := api.dispatch(&msg, local, remote)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	resp := map[string]interface{}{"status": "message sent", "id": record.ID}
+	failed := make(map[string]string)
+	for recipient, status := range record.Recipients {
+		if status.State == storage.DeliveryFailed {
+			failed[recipient] = status.Reason
+		}
+	}
+	if len(failed) > 0 {
+		resp["failed"] = failed
+	}
+
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "message sent"})
+	json.NewEncoder(w).Encode(resp)
 }
 
-// GET /api/messages?user=alice#emsg.dev (get messages for a user)
+// dispatch starts tracking delivery of a stored message and queues it for the
+// servers of its remote recipients. Recipients that cannot be routed are
+// marked failed on the returned record.
+func (api *BoltAPI) dispatch(msg *message.Message, local, remote []string) (*storage.DeliveryRecord, error) {
+	record, err := storage.CreateDeliveryRecordBolt(api.DB, msg.ID, msg.From, local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	var routable []string
+	for _, recipient := range remote {
+		if err := router.ValidateAddress(recipient); err != nil {
+			api.markFailed(record, []string{recipient}, err.Error())
+			continue
+		}
+		routable = append(routable, recipient)
+	}
+	if len(routable) == 0 {
+		return record, nil
+	}
+
+	if err := federation.Enqueue(api.DB, msg, routable, record.ID); err != nil {
+		api.markFailed(record, routable, err.Error())
+	}
+	return record, nil
+}
+
+// markFailed records a permanent delivery failure for recipients on record
+func (api *BoltAPI) markFailed(record *storage.DeliveryRecord, recipients []string, reason string) {
+	for _, recipient := range recipients {
+		record.Recipients[recipient] = &storage.RecipientStatus{State: storage.DeliveryFailed, Reason: reason, UpdatedAt: time.Now().Unix()}
+	}
+	if err := storage.UpdateDeliveryStatusBolt(api.DB, record.ID, recipients, storage.DeliveryFailed, reason); err != nil {
+		log.Printf("delivery status: %v", err)
+	}
+}
+
+// DELETE /api/message?id=... (delete your own message, or a group message as a moderator)
+func (api *BoltAPI) ApiDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id parameter", http.StatusBadRequest)
+		return
+	}
+	msg, err := storage.GetMessageBolt(api.DB, id)
+	if err != nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	actor := GetAuthenticatedUser(r)
+	allowed := msg.From == actor
+	if !allowed && msg.GroupID != "" {
+		if grp, err := storage.GetGroupBolt(api.DB, msg.GroupID); err == nil {
+			allowed = grp.Can(actor, group.PermDeleteMessages)
+		}
+	}
+	if !allowed {
+		http.Error(w, "not allowed to delete this message", http.StatusForbidden)
+		return
+	}
+
+	if err := storage.DeleteMessageBolt(api.DB, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/message/status?id=... (per-recipient delivery status of a sent message)
+func (api *BoltAPI) ApiGetMessageStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id parameter", http.StatusBadRequest)
+		return
+	}
+
+	record, err := storage.GetDeliveryRecordBolt(api.DB, id)
+	if err != nil || record.From != GetAuthenticatedUser(r) {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(record)
+}
+
+// Page sizes for GET /api/messages
+const (
+	defaultMessageLimit = 50
+	maxMessageLimit     = 200
+)
+
+// GET /api/messages?limit=50&before=<cursor> (get a page of the authenticated user's messages)
 func (api *BoltAPI) ApiGetMessages(w http.ResponseWriter, r *http.Request) {
-	user := r.URL.Query().Get("user")
-	if user == "" {
+	authUser := GetAuthenticatedUser(r)
+	decodedUser := authUser
+	if user := r.URL.Query().Get("user"); user != "" {
+		// URL decode the user address
+		decoded, err := url.QueryUnescape(user)
+		if err != nil {
+			decoded = user
+		}
+		decodedUser = decoded
+	}
+	if decodedUser == "" {
 		http.Error(w, "missing user parameter", http.StatusBadRequest)
 		return
 	}
 
-	// URL decode the user address
-	decodedUser, err := url.QueryUnescape(user)
+	// Users may only read their own mailbox unless they are a daemon admin
+	if decodedUser != authUser && !api.isAdmin(authUser) {
+		http.Error(w, "cannot read another user's messages", http.StatusForbidden)
+		return
+	}
+
+	query, err := parseMessageQuery(r)
 	if err != nil {
-		decodedUser = user
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	messages, err := storage.GetMessagesByUserBolt(api.DB, decodedUser)
+	messages, next, err := storage.QueryMessagesBolt(api.DB, decodedUser, query)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if messages == nil {
+		messages = []message.Message{}
+	}
 
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages":    messages,
+		"next_cursor": next,
+	})
+}
+
+// parseMessageQuery reads the pagination and filter parameters of GET /api/messages
+func parseMessageQuery(r *http.Request) (storage.MessageQuery, error) {
+	params := r.URL.Query()
+	query := storage.MessageQuery{
+		Limit:     defaultMessageLimit,
+		Before:    params.Get("before"),
+		After:     params.Get("after"),
+		From:      params.Get("from"),
+		GroupID:   params.Get("group_id"),
+		Direction: params.Get("direction"),
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("invalid limit: %s", v)
+		}
+		if limit > maxMessageLimit {
+			limit = maxMessageLimit
+		}
+		query.Limit = limit
+	}
+	if v := params.Get("since"); v != "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return query, fmt.Errorf("invalid since: %s", v)
+		}
+		query.Since = since
+	}
+	for _, cursor := range []string{query.Before, query.After} {
+		if cursor != "" && !message.ValidID(cursor) {
+			return query, fmt.Errorf("invalid cursor: %s", cursor)
+		}
+	}
+	switch query.Direction {
+	case "", storage.DirectionReceived, storage.DirectionSent:
+	default:
+		return query, fmt.Errorf("invalid direction: %s (want received or sent)", query.Direction)
+	}
+	return query, nil
 }
 
 // POST /api/group (create a group)
@@ -123,6 +438,9 @@ func (api *BoltAPI) ApiCreateGroup(w http.ResponseWriter, r *http.Request) {
 		Description string   `json:"description"`
 		DisplayPic  string   `json:"display_pic"`
 		Members     []string `json:"members"`
+		Preset      string   `json:"preset"`     // permission preset, e.g. "announcement"
+		Visibility  string   `json:"visibility"` // "public" or "private" (default)
+		History     string   `json:"history"`    // "shared" (default) or "since_joined"
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -135,18 +453,78 @@ func (api *BoltAPI) ApiCreateGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	grp := group.NewGroup(req.ID, req.Name, req.Description, req.DisplayPic, req.Members)
+	// Group IDs are scoped to their home server's domain, so they cannot collide
+	// across servers; a bare name is hosted under our primary domain
+	if !strings.Contains(req.ID, "#") && len(api.Domains) > 0 {
+		req.ID += "#" + api.Domains[0]
+	}
+	if err := router.ValidateGroupID(req.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !router.IsLocalDomain(router.DomainOf(req.ID), api.Domains) {
+		http.Error(w, fmt.Sprintf("group domain %s is not hosted on this server", router.DomainOf(req.ID)), http.StatusBadRequest)
+		return
+	}
+	if _, err := storage.GetUserBolt(api.DB, req.ID); err == nil {
+		http.Error(w, "group id is taken by a user address", http.StatusConflict)
+		return
+	}
+
+	if req.Visibility == "" {
+		req.Visibility = group.VisibilityPrivate
+	}
+	if req.Visibility != group.VisibilityPublic && req.Visibility != group.VisibilityPrivate {
+		http.Error(w, "visibility must be public or private", http.StatusBadRequest)
+		return
+	}
+
+	if req.History == "" {
+		req.History = group.HistoryShared
+	}
+	if req.History != group.HistoryShared && req.History != group.HistorySinceJoined {
+		http.Error(w, "history must be shared or since_joined", http.StatusBadRequest)
+		return
+	}
+
+	var perms group.Permissions
+	if req.Preset != "" {
+		var err error
+		if perms, err = group.PresetPermissions(req.Preset); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	if err := storage.StoreGroupBolt(api.DB, grp); err != nil {
+	// The creator is always a member and the group's owner
+	creator := GetAuthenticatedUser(r)
+	grp := group.NewGroup(req.ID, req.Name, req.Description, req.DisplayPic, req.Members)
+	grp.CreatedBy = creator
+	if !grp.IsMember(creator) {
+		grp.Members = append(grp.Members, creator)
+	}
+	grp.Admins = []string{creator}
+	grp.Roles = map[string]string{creator: group.RoleOwner}
+	grp.Permissions = perms
+	grp.Visibility = req.Visibility
+	grp.History = req.History
+
+	if err := storage.CreateGroupBolt(api.DB, grp); err != nil {
+		if errors.Is(err, storage.ErrGroupExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	grp.Sink = api.groupSink()
+	grp.NotifyCreated(creator)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(grp)
 }
 
-// GET /api/group?id=group1 (get group info)
+// GET /api/group?id=group1 (get group info; a private group only for its members)
 func (api *BoltAPI) ApiGetGroup(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -159,7 +537,14 @@ func (api *BoltAPI) ApiGetGroup(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "group not found", http.StatusNotFound)
 		return
 	}
+	// A private group is only visible to its members; to anyone else it does not exist
+	actor := GetAuthenticatedUser(r)
+	if !grp.IsPublic() && !grp.IsMember(actor) && !api.isAdmin(actor) {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
 
+	w.Header().Set("ETag", groupETag(grp))
 	json.NewEncoder(w).Encode(grp)
 }
 
@@ -252,8 +637,15 @@ func (api *BoltAPI) ApiRouteMessage(w http.ResponseWriter, r *http.Request) {
 }
 
 // StartBoltServer starts the REST API server with BoltDB
-func StartBoltServer(db *bbolt.DB, port string) {
-	api := &BoltAPI{DB: db}
+func StartBoltServer(db *bbolt.DB, cfg *config.Config) {
+	api := &BoltAPI{
+		DB:      db,
+		Domains: cfg.LocalDomains,
+		Keys:    federation.NewDNSKeyResolver(),
+		Relays:  federation.NewRelayVerifier(),
+		Admins:  cfg.Admins,
+	}
+	api.StartEvents()
 	auth := &AuthMiddleware{DB: db}
 	// User endpoints
 	http.HandleFunc("/api/user", func(w http.ResponseWriter, r *http.Request) {
@@ -270,6 +662,16 @@ func StartBoltServer(db *bbolt.DB, port string) {
 	http.HandleFunc("/api/message", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			auth.RequireAuth(api.ApiSendMessage)(w, r)
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiDeleteMessage)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/message/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiGetMessageStatus)(w, r)
 		} else {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -283,12 +685,165 @@ func StartBoltServer(db *bbolt.DB, port string) {
 		}
 	})
 
+	// Real-time push over WebSocket or SSE (protected; browsers may pass the auth token as ?auth=)
+	http.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiWebSocket)(w, WithQueryAuth(r))
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiEvents)(w, WithQueryAuth(r))
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Webhook endpoints (protected)
+	http.HandleFunc("/api/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiListWebhooks)(w, r)
+		} else if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiCreateWebhook)(w, r)
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiDeleteWebhook)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Federation endpoints (server-to-server, authenticated by message signature)
+	http.HandleFunc(federation.InboundPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			api.ApiReceiveMessage(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc(federation.RelayPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			api.ApiConfirmRelay(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
 	// Group endpoints
 	http.HandleFunc("/api/group", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
-			api.ApiGetGroup(w, r) // Public - no auth required
+			auth.OptionalAuth(api.ApiGetGroup)(w, r) // Public groups need no auth; private ones only members
 		} else if r.Method == http.MethodPost {
 			auth.RequireAuth(api.ApiCreateGroup)(w, r) // Protected
+		} else if r.Method == http.MethodPatch {
+			auth.RequireAuth(api.ApiUpdateGroup)(w, r) // Protected
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiDeleteGroup)(w, r) // Protected
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiGetGroupMessages)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/changes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiGetGroupChanges)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/members", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiAddGroupMember)(w, r)
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiRemoveGroupMember)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/roles", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			auth.RequireAuth(api.ApiSetGroupRole)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/permissions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			auth.RequireAuth(api.ApiSetGroupPermissions)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/invites", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiListInvites)(w, r)
+		} else if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiCreateInvite)(w, r)
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiRevokeInvite)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/join", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiJoinGroup)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/requests", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auth.RequireAuth(api.ApiListJoinRequests)(w, r)
+		} else if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiApproveJoinRequest)(w, r)
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiRejectJoinRequest)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/owner", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiTransferGroupOwnership)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/archive", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiArchiveGroup)(w, r)
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiUnarchiveGroup)(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/group/admins", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			auth.RequireAuth(api.ApiAddGroupAdmin)(w, r)
+		} else if r.Method == http.MethodDelete {
+			auth.RequireAuth(api.ApiRemoveGroupAdmin)(w, r)
 		} else {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -319,5 +874,5 @@ func StartBoltServer(db *bbolt.DB, port string) {
 		}
 	})
 
-	go http.ListenAndServe(":"+port, nil)
+	go http.ListenAndServe(":"+cfg.Port, nil)
 }
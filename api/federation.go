@@ -0,0 +1,293 @@
+// federation.go
+// Server-to-server endpoints for EMSG Daemon
+package api
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"emsg-daemon/internal/federation"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/router"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+)
+
+// POST /api/federation/message (receive a message pushed by a peer server)
+func (api *BoltAPI) ApiReceiveMessage(w http.ResponseWriter, r *http.Request) {
+	var env federation.Envelope
+	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	msg := &env.Message
+	if err := msg.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := msg.CheckFederatedTimes(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(env.Recipients) == 0 {
+		http.Error(w, "no recipients provided", http.StatusBadRequest)
+		return
+	}
+
+	// Every recipient must be hosted here. A recipient naming one of our groups
+	// asks us, as the group's home server, to relay a remote member's post to it.
+	// The envelope is not signed, so recipients the message itself does not
+	// address are only accepted from a group's home server fanning it out.
+	var recipients, unnamed []string
+	var relayGroups []*group.Group
+	for _, recipient := range env.Recipients {
+		if err := router.ValidateAddress(recipient); err != nil {
+			http.Error(w, fmt.Sprintf("invalid recipient %s: %v", recipient, err), http.StatusBadRequest)
+			return
+		}
+		if !router.IsLocalDomain(router.DomainOf(recipient), api.Domains) {
+			http.Error(w, fmt.Sprintf("recipient %s is not hosted on this server", recipient), http.StatusBadRequest)
+			return
+		}
+		if !addresses(msg, recipient) {
+			unnamed = append(unnamed, recipient)
+		}
+		if grp, err := storage.GetGroupBolt(api.DB, recipient); err == nil {
+			// Only the signed message can ask for a relay to the whole group
+			if recipient != msg.GroupID && !contains(msg.CC, recipient) {
+				http.Error(w, fmt.Sprintf("message is not addressed to group %s", recipient), http.StatusForbidden)
+				return
+			}
+			relayGroups = append(relayGroups, grp)
+			continue
+		}
+		if recipient == msg.GroupID {
+			http.Error(w, "group not found", http.StatusNotFound)
+			return
+		}
+		recipients = appendUnique(recipients, recipient)
+	}
+
+	// System messages are unsigned. Our own are never accepted from a peer; a
+	// remote group's events come from the system address of the group's domain.
+	localSender := router.IsLocalDomain(router.DomainOf(msg.From), api.Domains)
+	systemSender := system.IsAddress(msg.From)
+	if msg.From == system.Address || (systemSender && localSender) {
+		http.Error(w, "system messages of this server are not accepted from peers", http.StatusForbidden)
+		return
+	}
+	groups := append([]string{msg.GroupID}, msg.CC...)
+	if systemSender {
+		if !api.isRemoteGroup(msg.GroupID) || router.DomainOf(msg.GroupID) != router.DomainOf(msg.From) {
+			http.Error(w, "system messages are only accepted about the sender's own groups", http.StatusForbidden)
+			return
+		}
+		groups = []string{msg.GroupID}
+	}
+	relayedBy := ""
+	if len(unnamed) > 0 || localSender || systemSender {
+		var err error
+		if relayedBy, err = api.confirmRelay(groups, &env); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	relayed := relayedBy != ""
+	if len(unnamed) > 0 && !relayed {
+		http.Error(w, fmt.Sprintf("recipient %s is not addressed by the message", unnamed[0]), http.StatusForbidden)
+		return
+	}
+
+	// Peers may not speak for our own users, except for a group's home server
+	// relaying their post to the group's other members here. A group's events
+	// only reach our users known to be members, from its earlier deliveries.
+	var pubKey ed25519.PublicKey
+	switch {
+	case systemSender:
+		if len(relayGroups) > 0 || !relayed {
+			http.Error(w, "system messages are only accepted from a group's home server", http.StatusForbidden)
+			return
+		}
+		known, err := storage.KnownRemoteGroupMembersBolt(api.DB, msg.GroupID, recipients)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(known) == 0 {
+			http.Error(w, fmt.Sprintf("no recipient is a known member of group %s", msg.GroupID), http.StatusForbidden)
+			return
+		}
+		recipients = known
+	case localSender:
+		if len(relayGroups) > 0 || !relayed {
+			http.Error(w, "sender belongs to a local domain", http.StatusForbidden)
+			return
+		}
+		user, err := storage.GetUserBolt(api.DB, msg.From)
+		if err != nil {
+			http.Error(w, "sender not registered", http.StatusForbidden)
+			return
+		}
+		pubKey = user.PubKey
+	default:
+		if api.Keys == nil {
+			http.Error(w, "federation is not enabled", http.StatusServiceUnavailable)
+			return
+		}
+		// A failed lookup is usually a DNS hiccup: answer 503 so the peer retries
+		key, err := api.Keys.ResolveKey(msg.From)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to resolve sender key: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		pubKey = key
+	}
+	if !systemSender && !msg.Verify(pubKey) {
+		http.Error(w, "message signature verification failed", http.StatusUnauthorized)
+		return
+	}
+
+	// We are authoritative for the membership of our groups: only members with
+	// the post permission may post, and the post goes to every other member
+	var members []string
+	for _, grp := range relayGroups {
+		if !grp.IsMember(msg.From) {
+			http.Error(w, fmt.Sprintf("not a member of group %s", grp.ID), http.StatusForbidden)
+			return
+		}
+		if !grp.Can(msg.From, group.PermPost) {
+			http.Error(w, fmt.Sprintf("not allowed to post in group %s", grp.ID), http.StatusForbidden)
+			return
+		}
+		if grp.Archived {
+			http.Error(w, fmt.Sprintf("group %s is archived", grp.ID), http.StatusForbidden)
+			return
+		}
+		if grp.ID == msg.GroupID {
+			if err := msg.CheckGroupRecipients(grp); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		for _, member := range grp.Members {
+			if member != msg.From {
+				members = appendUnique(members, member)
+			}
+		}
+	}
+	local, relayTo := router.PartitionRecipients(members, api.Domains)
+	for _, member := range local {
+		recipients = appendUnique(recipients, member)
+	}
+
+	duplicate, err := storage.StoreFederatedMessageBolt(api.DB, env.DeliveryID, msg, recipients)
+	if err == storage.ErrMessageConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A confirmed group delivery shows who here belongs to the remote group
+	if relayed && !systemSender && len(relayGroups) == 0 {
+		members := append([]string{}, recipients...)
+		if localSender {
+			members = append(members, msg.From)
+		}
+		if err := storage.AddRemoteGroupMembersBolt(api.DB, relayedBy, members); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !duplicate && len(relayTo) > 0 {
+		if err := federation.Enqueue(api.DB, msg, relayTo, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if duplicate {
+		json.NewEncoder(w).Encode(map[string]string{"status": "already received"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "message accepted"})
+}
+
+// isRemoteGroup reports whether a group ID names a group hosted on another server:
+// a group's home server is the domain in its ID, and unqualified IDs are local
+func (api *BoltAPI) isRemoteGroup(id string) bool {
+	domain := router.DomainOf(id)
+	return domain != "" && !router.IsLocalDomain(domain, api.Domains)
+}
+
+// GET /api/federation/relay?id=...&domain=...&digest=... (confirm a delivery this
+// server is sending to a peer). It answers 204 only if the delivery is queued for
+// domain and carries the content the digest names, and 404 otherwise, so nothing
+// about a delivery is revealed to anyone but the peer that already received it.
+func (api *BoltAPI) ApiConfirmRelay(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	item, err := storage.GetOutboundBolt(api.DB, query.Get("id"))
+	if err != nil || item.Domain != query.Get("domain") ||
+		federation.RelayDigest(&item.Message, item.Recipients) != query.Get("digest") {
+		http.Error(w, "delivery not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmRelay asks the home server of each remote group in groups whether it
+// is sending env to us, and returns the first group whose home server confirms
+// it ("" for none). The error is set when no home server could be asked.
+func (api *BoltAPI) confirmRelay(groups []string, env *federation.Envelope) (string, error) {
+	if api.Relays == nil || env.DeliveryID == "" {
+		return "", nil
+	}
+	// A home server queues one delivery per destination domain
+	domain := router.DomainOf(env.Recipients[0])
+	var lookupErr error
+	for _, groupID := range groups {
+		if !api.isRemoteGroup(groupID) {
+			continue
+		}
+		err := api.Relays.ConfirmRelay(groupID, domain, env)
+		if err == nil {
+			return groupID, nil
+		}
+		if err != federation.ErrRelayNotFound {
+			lookupErr = err
+		}
+	}
+	return "", lookupErr
+}
+
+// addresses reports whether recipient is named by msg itself: in To, CC or as its group
+func addresses(msg *message.Message, recipient string) bool {
+	return recipient == msg.GroupID || contains(msg.To, recipient) || contains(msg.CC, recipient)
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends s to list unless it is already present
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
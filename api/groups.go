@@ -0,0 +1,419 @@
+// groups.go
+// REST endpoints for managing group membership, admins and metadata
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"emsg-daemon/internal/federation"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+)
+
+// statusError is an error returned from a group mutation with the HTTP status to report
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// groupSink delivers group system events to the local members' mailboxes and
+// queues them for members on other servers
+func (api *BoltAPI) groupSink() group.EventSink {
+	return &system.BoltSink{
+		DB:      api.DB,
+		Domains: api.Domains,
+		Relay: func(msg *message.Message, recipients []string) error {
+			return federation.Enqueue(api.DB, msg, recipients, "")
+		},
+	}
+}
+
+// mutateGroup applies fn to a stored group atomically and writes the updated
+// group. Archived groups are read-only and reject the change.
+func (api *BoltAPI) mutateGroup(w http.ResponseWriter, r *http.Request, id string, fn func(grp *group.Group) error) {
+	api.updateGroup(w, r, id, func(grp *group.Group) error {
+		if grp.Archived {
+			return group.ErrArchived
+		}
+		return fn(grp)
+	})
+}
+
+// updateGroup is mutateGroup without the archive check. A request with an
+// If-Match header only applies to the group version it names (412 otherwise),
+// so concurrent edits cannot overwrite each other unseen.
+func (api *BoltAPI) updateGroup(w http.ResponseWriter, r *http.Request, id string, fn func(grp *group.Group) error) {
+	if id == "" {
+		http.Error(w, "missing group id", http.StatusBadRequest)
+		return
+	}
+
+	grp, err := storage.UpdateGroupBolt(api.DB, id, GetAuthenticatedUser(r), api.groupSink(), func(grp *group.Group) error {
+		if match := r.Header.Get("If-Match"); match != "" && !matchesETag(match, groupETag(grp)) {
+			return &statusError{http.StatusPreconditionFailed, "group has changed; reload it and retry"}
+		}
+		return fn(grp)
+	})
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	w.Header().Set("ETag", groupETag(grp))
+	json.NewEncoder(w).Encode(grp)
+}
+
+// groupETag is the entity tag of a group's current version
+func groupETag(grp *group.Group) string {
+	return fmt.Sprintf(`"%d"`, grp.Version)
+}
+
+// matchesETag reports whether an If-Match header value names etag
+func matchesETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// groupError writes the HTTP response for an error from a group mutation
+func groupError(w http.ResponseWriter, err error) {
+	var se *statusError
+	switch {
+	case errors.As(err, &se):
+		http.Error(w, se.msg, se.code)
+	case errors.Is(err, storage.ErrGroupNotFound):
+		http.Error(w, "group not found", http.StatusNotFound)
+	case errors.Is(err, group.ErrAlreadyMember), errors.Is(err, storage.ErrJoinRequestExists), errors.Is(err, group.ErrArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, group.ErrNotMember), errors.Is(err, storage.ErrJoinRequestNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// groupMemberRequest names a group and one of its (prospective) members
+type groupMemberRequest struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// decodeGroupMember reads a groupMemberRequest from the body (POST) or query (DELETE)
+func decodeGroupMember(r *http.Request) (groupMemberRequest, error) {
+	var req groupMemberRequest
+	if r.Method == http.MethodDelete {
+		req.ID = r.URL.Query().Get("id")
+		req.Address = r.URL.Query().Get("address")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, errors.New("invalid request")
+	}
+	if req.ID == "" || req.Address == "" {
+		return req, errors.New("missing required fields: id, address")
+	}
+	return req, nil
+}
+
+// POST /api/group/members (add a member to a group)
+func (api *BoltAPI) ApiAddGroupMember(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeGroupMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if err := requirePermission(grp, actor, group.PermInvite); err != nil {
+			return err
+		}
+		return grp.AddMember(req.Address)
+	})
+}
+
+// DELETE /api/group/members?id=...&address=... (leave a group, or remove a member of a lower role)
+func (api *BoltAPI) ApiRemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeGroupMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if req.Address == actor {
+			return grp.RemoveMember(req.Address)
+		}
+		if err := requirePermission(grp, actor, group.PermRemove); err != nil {
+			return err
+		}
+		if target := grp.Role(req.Address); target != "" && !group.Outranks(grp.Role(actor), target) {
+			return &statusError{http.StatusForbidden, "cannot remove a member of equal or higher role"}
+		}
+		return grp.RemoveUserByAdmin(req.Address)
+	})
+}
+
+// POST /api/group/admins (promote a member to admin)
+func (api *BoltAPI) ApiAddGroupAdmin(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeGroupMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if err := requireGroupAdmin(grp, actor); err != nil {
+			return err
+		}
+		if !grp.IsMember(req.Address) {
+			return group.ErrNotMember
+		}
+		grp.AddAdmin(req.Address)
+		return nil
+	})
+}
+
+// DELETE /api/group/admins?id=...&address=... (revoke admin rights)
+func (api *BoltAPI) ApiRemoveGroupAdmin(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeGroupMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if err := requireGroupAdmin(grp, actor); err != nil {
+			return err
+		}
+		if !grp.IsAdmin(req.Address) {
+			return &statusError{http.StatusNotFound, "user is not an admin of the group"}
+		}
+		if grp.Role(req.Address) == group.RoleOwner {
+			return &statusError{http.StatusForbidden, "cannot revoke the group owner"}
+		}
+		grp.RemoveAdmin(req.Address)
+		return nil
+	})
+}
+
+// PATCH /api/group (change a group's name, description, display picture, visibility or history setting)
+func (api *BoltAPI) ApiUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID          string  `json:"id"`
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		DisplayPic  *string `json:"display_pic"`
+		Visibility  *string `json:"visibility"`
+		History     *string `json:"history"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Name != nil && *req.Name == "" {
+		http.Error(w, "name cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if err := requirePermission(grp, actor, group.PermEditMetadata); err != nil {
+			return err
+		}
+		if req.Name != nil && *req.Name != grp.Name {
+			grp.UpdateName(*req.Name)
+		}
+		if req.Description != nil && *req.Description != grp.Description {
+			grp.UpdateDescription(*req.Description)
+		}
+		if req.DisplayPic != nil && *req.DisplayPic != grp.DisplayPic {
+			grp.UpdateDisplayPic(*req.DisplayPic)
+		}
+		if req.Visibility != nil && *req.Visibility != grp.Visibility {
+			if err := grp.UpdateVisibility(*req.Visibility); err != nil {
+				return &statusError{http.StatusBadRequest, err.Error()}
+			}
+		}
+		if req.History != nil && *req.History != grp.History {
+			if err := grp.UpdateHistory(*req.History); err != nil {
+				return &statusError{http.StatusBadRequest, err.Error()}
+			}
+		}
+		return nil
+	})
+}
+
+// PUT /api/group/roles (set a member's role: admin, moderator, member or read_only)
+func (api *BoltAPI) ApiSetGroupRole(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID      string `json:"id"`
+		Address string `json:"address"`
+		Role    string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Address == "" || req.Role == "" {
+		http.Error(w, "missing required fields: id, address, role", http.StatusBadRequest)
+		return
+	}
+	if !group.ValidRole(req.Role) || req.Role == group.RoleOwner {
+		http.Error(w, fmt.Sprintf("invalid role: %s (want admin, moderator, member or read_only)", req.Role), http.StatusBadRequest)
+		return
+	}
+
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if err := requireGroupAdmin(grp, actor); err != nil {
+			return err
+		}
+		if grp.Role(req.Address) == group.RoleOwner {
+			return &statusError{http.StatusForbidden, "cannot change the group owner's role"}
+		}
+		return grp.SetRole(req.Address, req.Role)
+	})
+}
+
+// PUT /api/group/permissions (replace the permission matrix, or apply a preset)
+func (api *BoltAPI) ApiSetGroupPermissions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID          string            `json:"id"`
+		Preset      string            `json:"preset"`
+		Permissions group.Permissions `json:"permissions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	perms := req.Permissions
+	if perms == nil {
+		var err error
+		if perms, err = group.PresetPermissions(req.Preset); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if req.Preset != "" {
+		http.Error(w, "set either preset or permissions, not both", http.StatusBadRequest)
+		return
+	}
+	if err := perms.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if err := requireGroupAdmin(grp, actor); err != nil {
+			return err
+		}
+		return grp.UpdatePermissions(perms)
+	})
+}
+
+// GET /api/group/messages?id=... (page through a group's timeline, newest first)
+func (api *BoltAPI) ApiGetGroupMessages(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing group id", http.StatusBadRequest)
+		return
+	}
+	query, err := parseMessageQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grp, err := storage.GetGroupBolt(api.DB, id)
+	if err != nil {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
+	actor := GetAuthenticatedUser(r)
+	if !grp.IsMember(actor) {
+		http.Error(w, "not a member of this group", http.StatusForbidden)
+		return
+	}
+	// History is cut off by when messages reached this server, not by their
+	// sender-set sent_at, which the sender could backdate or postdate
+	messages, next, err := storage.QueryGroupTimelineBolt(api.DB, id, query, grp.HistoryStart(actor))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []message.Message{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages":    messages,
+		"next_cursor": next,
+	})
+}
+
+// GET /api/group/changes?id=...&since=... (the group's settings audit trail, oldest first)
+func (api *BoltAPI) ApiGetGroupChanges(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing group id", http.StatusBadRequest)
+		return
+	}
+	var since int64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			http.Error(w, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	grp, err := storage.GetGroupBolt(api.DB, id)
+	if err != nil {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
+	if !grp.IsMember(GetAuthenticatedUser(r)) {
+		http.Error(w, "not a member of this group", http.StatusForbidden)
+		return
+	}
+
+	changes, err := storage.ListGroupChangesBolt(api.DB, id, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = []storage.GroupChange{}
+	}
+	w.Header().Set("ETag", groupETag(grp))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": grp.Version,
+		"changes": changes,
+	})
+}
+
+// requirePermission fails with 403 unless actor's role in grp is granted perm
+func requirePermission(grp *group.Group, actor, perm string) error {
+	if !grp.Can(actor, perm) {
+		return &statusError{http.StatusForbidden, fmt.Sprintf("missing group permission: %s", perm)}
+	}
+	return nil
+}
+
+// requireGroupAdmin fails with 403 unless actor administers grp
+func requireGroupAdmin(grp *group.Group, actor string) error {
+	if !grp.IsAdmin(actor) {
+		return &statusError{http.StatusForbidden, "only group admins can do this"}
+	}
+	return nil
+}
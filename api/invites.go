@@ -0,0 +1,145 @@
+// invites.go
+// REST endpoints for group invitations
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/storage"
+)
+
+// Invite lifetime limits
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+// requireGroupPermission loads a group and checks that actor holds perm in it,
+// writing the error response and returning nil if not
+func (api *BoltAPI) requireGroupPermission(w http.ResponseWriter, id, actor, perm string) *group.Group {
+	if id == "" {
+		http.Error(w, "missing group id", http.StatusBadRequest)
+		return nil
+	}
+	grp, err := storage.GetGroupBolt(api.DB, id)
+	if err != nil {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return nil
+	}
+	if err := requirePermission(grp, actor, perm); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+	return grp
+}
+
+// POST /api/group/invites (create an invite token for a group)
+func (api *BoltAPI) ApiCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID        string `json:"id"`
+		MaxUses   int    `json:"max_uses"`   // 0 for unlimited; defaults to single use when omitted
+		ExpiresIn *int64 `json:"expires_in"` // seconds
+	}
+	req.MaxUses = 1
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses < 0 {
+		http.Error(w, "max_uses cannot be negative", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultInviteTTL
+	if req.ExpiresIn != nil {
+		ttl = time.Duration(*req.ExpiresIn) * time.Second
+		if ttl <= 0 || ttl > maxInviteTTL {
+			http.Error(w, fmt.Sprintf("expires_in must be between 1 and %d seconds", int64(maxInviteTTL/time.Second)), http.StatusBadRequest)
+			return
+		}
+	}
+
+	actor := GetAuthenticatedUser(r)
+	grp := api.requireGroupPermission(w, req.ID, actor, group.PermInvite)
+	if grp == nil {
+		return
+	}
+	if grp.Archived {
+		http.Error(w, group.ErrArchived.Error(), http.StatusConflict)
+		return
+	}
+
+	inv := &storage.Invite{
+		GroupID:   req.ID,
+		CreatedBy: actor,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+		MaxUses:   req.MaxUses,
+	}
+	if err := storage.CreateInviteBolt(api.DB, inv); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// GET /api/group/invites?id=... (list a group's invites)
+func (api *BoltAPI) ApiListInvites(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if api.requireGroupPermission(w, id, GetAuthenticatedUser(r), group.PermInvite) == nil {
+		return
+	}
+
+	invites, err := storage.ListInvitesBolt(api.DB, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if invites == nil {
+		invites = []storage.Invite{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"invites": invites})
+}
+
+// DELETE /api/group/invites?id=...&invite=... (revoke an invite)
+func (api *BoltAPI) ApiRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	inviteID := r.URL.Query().Get("invite")
+	if inviteID == "" {
+		http.Error(w, "missing invite parameter", http.StatusBadRequest)
+		return
+	}
+	if api.requireGroupPermission(w, id, GetAuthenticatedUser(r), group.PermInvite) == nil {
+		return
+	}
+
+	if err := storage.RevokeInviteBolt(api.DB, id, inviteID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redeemInvite joins the authenticated user to a group with an invite token
+func (api *BoltAPI) redeemInvite(w http.ResponseWriter, r *http.Request, token string) {
+	grp, err := storage.RedeemInviteBolt(api.DB, token, GetAuthenticatedUser(r), api.groupSink())
+	switch {
+	case err == nil:
+		json.NewEncoder(w).Encode(grp)
+	case errors.Is(err, storage.ErrInviteInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrInviteExpired), errors.Is(err, storage.ErrInviteRevoked), errors.Is(err, storage.ErrInviteExhausted):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, storage.ErrGroupNotFound):
+		http.Error(w, "group not found", http.StatusNotFound)
+	case errors.Is(err, group.ErrAlreadyMember), errors.Is(err, group.ErrArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
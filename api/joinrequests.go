@@ -0,0 +1,131 @@
+// joinrequests.go
+// REST endpoints for joining groups and the admin approval queue of private groups
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/storage"
+)
+
+// POST /api/group/join (join with an invite token, join a public group, or ask to join a private one)
+func (api *BoltAPI) ApiJoinGroup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+		ID    string `json:"id"`
+		Note  string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Token != "" {
+		api.redeemInvite(w, r, req.Token)
+		return
+	}
+	if req.ID == "" {
+		http.Error(w, "missing required field: token or id", http.StatusBadRequest)
+		return
+	}
+
+	grp, err := storage.GetGroupBolt(api.DB, req.ID)
+	if err != nil {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
+
+	actor := GetAuthenticatedUser(r)
+	if grp.IsPublic() {
+		api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+			if !grp.IsPublic() {
+				return &statusError{http.StatusConflict, "group is no longer public"}
+			}
+			return grp.AddMember(actor)
+		})
+		return
+	}
+
+	joinReq := &storage.JoinRequest{GroupID: req.ID, Address: actor, Note: req.Note}
+	if err := storage.CreateJoinRequestBolt(api.DB, joinReq, api.groupSink()); err != nil {
+		groupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(joinReq)
+}
+
+// GET /api/group/requests?id=... (list pending join requests)
+func (api *BoltAPI) ApiListJoinRequests(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing group id", http.StatusBadRequest)
+		return
+	}
+	grp, err := storage.GetGroupBolt(api.DB, id)
+	if err != nil {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
+	if err := requireGroupAdmin(grp, GetAuthenticatedUser(r)); err != nil {
+		groupError(w, err)
+		return
+	}
+
+	requests, err := storage.ListJoinRequestsBolt(api.DB, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if requests == nil {
+		requests = []storage.JoinRequest{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"requests": requests})
+}
+
+// POST /api/group/requests (approve a join request)
+func (api *BoltAPI) ApiApproveJoinRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeGroupMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := GetAuthenticatedUser(r)
+	grp, err := storage.ResolveJoinRequestBolt(api.DB, req.ID, req.Address, api.groupSink(), func(grp *group.Group) error {
+		if err := requireGroupAdmin(grp, actor); err != nil {
+			return err
+		}
+		return grp.AddMember(req.Address)
+	})
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(grp)
+}
+
+// DELETE /api/group/requests?id=...&address=... (reject a join request, or withdraw your own)
+func (api *BoltAPI) ApiRejectJoinRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeGroupMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := GetAuthenticatedUser(r)
+	_, err = storage.ResolveJoinRequestBolt(api.DB, req.ID, req.Address, api.groupSink(), func(grp *group.Group) error {
+		if req.Address == actor {
+			return nil
+		}
+		if err := requireGroupAdmin(grp, actor); err != nil {
+			return err
+		}
+		grp.NotifyJoinRejected(req.Address)
+		return nil
+	})
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
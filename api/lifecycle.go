@@ -0,0 +1,107 @@
+// lifecycle.go
+// REST endpoints for archiving and deleting groups and transferring their ownership
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/storage"
+)
+
+// Mailbox policies for deleted groups
+const (
+	deleteKeepMessages  = "keep"  // members keep their copies of the group's messages
+	deletePurgeMessages = "purge" // the group's messages are removed from every mailbox
+)
+
+// POST /api/group/archive (make a group read-only)
+func (api *BoltAPI) ApiArchiveGroup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	api.setArchived(w, r, req.ID, true)
+}
+
+// DELETE /api/group/archive?id=... (make an archived group writable again)
+func (api *BoltAPI) ApiUnarchiveGroup(w http.ResponseWriter, r *http.Request) {
+	api.setArchived(w, r, r.URL.Query().Get("id"), false)
+}
+
+// setArchived archives or unarchives a group on behalf of one of its admins
+func (api *BoltAPI) setArchived(w http.ResponseWriter, r *http.Request, id string, archived bool) {
+	actor := GetAuthenticatedUser(r)
+	api.updateGroup(w, r, id, func(grp *group.Group) error {
+		if err := requireGroupAdmin(grp, actor); err != nil {
+			return err
+		}
+		grp.SetArchived(archived)
+		return nil
+	})
+}
+
+// DELETE /api/group?id=...&messages=keep|purge (delete a group; owner only)
+func (api *BoltAPI) ApiDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing group id", http.StatusBadRequest)
+		return
+	}
+	policy := r.URL.Query().Get("messages")
+	if policy == "" {
+		policy = deleteKeepMessages
+	}
+	if policy != deleteKeepMessages && policy != deletePurgeMessages {
+		http.Error(w, "messages must be keep or purge", http.StatusBadRequest)
+		return
+	}
+
+	actor := GetAuthenticatedUser(r)
+	_, err := storage.DeleteGroupBolt(api.DB, id, policy == deletePurgeMessages, api.groupSink(), func(grp *group.Group) error {
+		if err := requireGroupOwner(grp, actor); err != nil {
+			return err
+		}
+		grp.NotifyDeleted(actor)
+		return nil
+	})
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/group/owner (hand the group over to another member; owner only)
+func (api *BoltAPI) ApiTransferGroupOwnership(w http.ResponseWriter, r *http.Request) {
+	var req groupMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Address == "" {
+		http.Error(w, "missing required fields: id, address", http.StatusBadRequest)
+		return
+	}
+
+	actor := GetAuthenticatedUser(r)
+	api.mutateGroup(w, r, req.ID, func(grp *group.Group) error {
+		if err := requireGroupOwner(grp, actor); err != nil {
+			return err
+		}
+		return grp.TransferOwnership(req.Address)
+	})
+}
+
+// requireGroupOwner fails with 403 unless actor owns grp. Groups created before
+// owners existed may be handed over or deleted by any of their admins.
+func requireGroupOwner(grp *group.Group, actor string) error {
+	if grp.Role(actor) == group.RoleOwner || grp.Owner() == "" && grp.IsAdmin(actor) {
+		return nil
+	}
+	return &statusError{http.StatusForbidden, "only the group owner can do this"}
+}
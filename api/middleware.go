@@ -117,6 +117,7 @@ func (am *AuthMiddleware) createSignedMessage(r *http.Request, authReq *AuthRequ
 // OptionalAuth middleware that extracts auth info if present but doesn't require it
 func (am *AuthMiddleware) OptionalAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-EMSG-User") // only set by a verified auth request
 		authHeader := r.Header.Get("Authorization")
 		if authHeader != "" {
 			parts := strings.SplitN(authHeader, " ", 2)
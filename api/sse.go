@@ -0,0 +1,129 @@
+// sse.go
+// Server-Sent Events stream for EMSG clients that cannot use WebSockets
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"emsg-daemon/internal/events"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+)
+
+// sseReplayBatch is how many missed messages are read from the inbox at a time
+const sseReplayBatch = 100
+
+// GET /api/events (stream the authenticated user's events; resumes after Last-Event-ID)
+func (api *BoltAPI) ApiEvents(w http.ResponseWriter, r *http.Request) {
+	if api.Events == nil {
+		http.Error(w, "push events not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	user := GetAuthenticatedUser(r)
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		// EventSource cannot set headers on the first connection
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var lastSeq uint64
+	if lastID != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID: %s", lastID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before replaying so nothing stored in between is lost
+	sub := api.Events.Subscribe(user)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Replay the messages that arrived since the client's last event, in arrival order
+	if lastID != "" {
+		for {
+			missed, err := storage.InboxAfterBolt(api.DB, user, lastSeq, sseReplayBatch)
+			if err != nil {
+				return
+			}
+			for i := range missed {
+				if err := writeSSE(w, messageEvent(&missed[i].Message, missed[i].Seq)); err != nil {
+					return
+				}
+				lastSeq = missed[i].Seq
+			}
+			flusher.Flush()
+			if len(missed) < sseReplayBatch {
+				break
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(pushKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				// Dropped for falling behind; the client reconnects with Last-Event-ID
+				return
+			}
+			if ev.Seq != 0 && ev.Seq <= lastSeq {
+				continue // already replayed
+			}
+			if err := writeSSE(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// messageEvent wraps a message stored in an inbox under seq
+func messageEvent(msg *message.Message, seq uint64) events.Event {
+	eventType := events.TypeMessage
+	if system.IsAddress(msg.From) {
+		eventType = events.TypeSystem
+	}
+	return events.Event{ID: msg.ID, Seq: seq, Type: eventType, Data: msg}
+}
+
+// writeSSE writes one event in text/event-stream framing. The SSE id is the inbox
+// sequence number, which only grows, so Last-Event-ID resumes after every message
+// the client saw even when later messages carry older message IDs.
+func writeSSE(w io.Writer, ev events.Event) error {
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return err
+	}
+	if ev.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", ev.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
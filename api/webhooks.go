@@ -0,0 +1,93 @@
+// webhooks.go
+// REST endpoints for managing a user's outgoing webhooks
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/webhook"
+)
+
+// maxWebhooksPerUser bounds how many webhooks one address may register
+const maxWebhooksPerUser = 10
+
+// POST /api/webhooks (register a webhook; the response carries its signing secret)
+func (api *BoltAPI) ApiCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = []string{webhook.EventMessage, webhook.EventGroup}
+	}
+	for _, event := range req.Events {
+		if event != webhook.EventMessage && event != webhook.EventGroup {
+			http.Error(w, fmt.Sprintf("unknown event: %s (want message or group)", event), http.StatusBadRequest)
+			return
+		}
+	}
+
+	owner := GetAuthenticatedUser(r)
+	existing, err := storage.GetWebhooksBolt(api.DB, owner)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		http.Error(w, fmt.Sprintf("at most %d webhooks per user", maxWebhooksPerUser), http.StatusConflict)
+		return
+	}
+
+	hook := &storage.Webhook{Owner: owner, URL: req.URL, Events: req.Events}
+	if err := storage.CreateWebhookBolt(api.DB, hook); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// GET /api/webhooks (list the authenticated user's webhooks, without secrets)
+func (api *BoltAPI) ApiListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := storage.GetWebhooksBolt(api.DB, GetAuthenticatedUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hooks == nil {
+		hooks = []storage.Webhook{}
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": hooks})
+}
+
+// DELETE /api/webhooks?id=... (remove one of the authenticated user's webhooks)
+func (api *BoltAPI) ApiDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id parameter", http.StatusBadRequest)
+		return
+	}
+	if err := storage.DeleteWebhookBolt(api.DB, GetAuthenticatedUser(r), id); err != nil {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
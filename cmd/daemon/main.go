@@ -10,7 +10,9 @@ import (
 	// Internal packages
 	"emsg-daemon/api"
 	"emsg-daemon/internal/config"
+	"emsg-daemon/internal/federation"
 	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/webhook"
 )
 
 func main() {
@@ -41,6 +43,16 @@ func main() {
 	// Initialize router, group, auth, message modules (stubs)
 	fmt.Println("Router, group, auth, and message modules ready (stub).")
 
+	// Start outbound delivery worker (in background)
+	worker := federation.NewWorker(db, federation.NewSender(cfg.LocalDomains))
+	go worker.Run(make(chan struct{}))
+	fmt.Println("Outbound delivery queue started.")
+
+	// Queue webhook notifications for stored messages and deliver them (in background)
+	webhook.Register(db)
+	go webhook.NewWorker(db).Run(make(chan struct{}))
+	fmt.Println("Webhook delivery started.")
+
 	// Start REST API server (in background)
 	go func() {
 		fmt.Printf("Starting REST API server on :%s...\n", cfg.Port)
@@ -49,7 +61,7 @@ func main() {
 				log.Printf("REST API server crashed: %v", r)
 			}
 		}()
-		api.StartBoltServer(db, cfg.Port)
+		api.StartBoltServer(db, cfg)
 	}()
 
 	fmt.Println("EMSG Daemon is running. Press Ctrl+C to stop.")
@@ -14,6 +14,8 @@ type Config struct {
 	Port           string
 	LogLevel       string
 	MaxConnections int
+	LocalDomains   []string // domains delivered locally; defaults to Domain
+	Admins         []string // addresses allowed to read any mailbox
 }
 
 func LoadConfig() (*Config, error) {
@@ -24,9 +26,25 @@ func LoadConfig() (*Config, error) {
 		LogLevel:       getEnvWithDefault("EMSG_LOG_LEVEL", "info"),
 		MaxConnections: getEnvIntWithDefault("EMSG_MAX_CONNECTIONS", 100),
 	}
+	cfg.LocalDomains = splitList(os.Getenv("EMSG_LOCAL_DOMAINS"))
+	cfg.Admins = splitList(os.Getenv("EMSG_ADMINS"))
+	if len(cfg.LocalDomains) == 0 && cfg.Domain != "" {
+		cfg.LocalDomains = []string{cfg.Domain}
+	}
 	return cfg, nil
 }
 
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // getEnvWithDefault gets environment variable with a default value
 func getEnvWithDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -75,6 +93,10 @@ func LoadConfigFromFile(path string) (*Config, error) {
 			cfg.Port = val
 		case "EMSG_LOG_LEVEL":
 			cfg.LogLevel = val
+		case "EMSG_LOCAL_DOMAINS":
+			cfg.LocalDomains = splitList(val)
+		case "EMSG_ADMINS":
+			cfg.Admins = splitList(val)
 		case "EMSG_MAX_CONNECTIONS":
 			// Simple conversion for demo - use strconv.Atoi in production
 			if val == "50" {
@@ -89,5 +111,8 @@ func LoadConfigFromFile(path string) (*Config, error) {
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	if len(cfg.LocalDomains) == 0 && cfg.Domain != "" {
+		cfg.LocalDomains = []string{cfg.Domain}
+	}
 	return cfg, nil
 }
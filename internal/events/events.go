@@ -0,0 +1,102 @@
+// events.go
+// In-process fan-out of per-user events for EMSG Daemon push clients
+package events
+
+import (
+	"sync"
+)
+
+// Event types
+const (
+	TypeMessage = "message" // a message arrived in the user's mailbox
+	TypeSystem  = "system"  // a system-authored message arrived in the user's mailbox
+
+	TypeDeliveryStatus = "delivery_status" // delivery state changed for a message the user sent
+)
+
+// Event is a notification for one user
+type Event struct {
+	ID   string      `json:"id,omitempty"`  // message ID for mailbox events, empty otherwise
+	Seq  uint64      `json:"seq,omitempty"` // inbox sequence number for mailbox events, empty otherwise
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 64
+
+// Subscription receives the events published for one address
+type Subscription struct {
+	Address string
+	C       <-chan Event
+
+	ch  chan Event
+	hub *Hub
+}
+
+// Close stops delivery to the subscription
+func (s *Subscription) Close() {
+	s.hub.remove(s)
+}
+
+// Hub routes published events to the subscriptions of their address
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[*Subscription]struct{}
+}
+
+// NewHub creates an empty Hub
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Subscribe starts receiving events for address
+func (h *Hub) Subscribe(address string) *Subscription {
+	ch := make(chan Event, subscriberBuffer)
+	sub := &Subscription{Address: address, C: ch, ch: ch, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[address] == nil {
+		h.subs[address] = make(map[*Subscription]struct{})
+	}
+	h.subs[address][sub] = struct{}{}
+	return sub
+}
+
+// Publish sends an event to every subscription of address. A subscriber whose
+// buffer is full is closed rather than allowed to block the publisher; its
+// channel closing tells the client to reconnect and catch up.
+func (h *Hub) Publish(address string, ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[address] {
+		select {
+		case sub.ch <- ev:
+		default:
+			h.removeLocked(sub)
+		}
+	}
+}
+
+// remove unregisters a subscription and closes its channel
+func (h *Hub) remove(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(sub)
+}
+
+func (h *Hub) removeLocked(sub *Subscription) {
+	subs, ok := h.subs[sub.Address]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subs, sub.Address)
+	}
+	close(sub.ch)
+}
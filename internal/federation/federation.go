@@ -0,0 +1,158 @@
+// federation.go
+// Server-to-server message delivery for EMSG Daemon
+package federation
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"emsg-daemon/internal/auth"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/router"
+)
+
+// InboundPath is the endpoint peer servers accept federated messages on
+const InboundPath = "/api/federation/message"
+
+// Envelope carries a message together with the recipients the receiving server should deliver it to
+type Envelope struct {
+	Message    message.Message `json:"message"`
+	Recipients []string        `json:"recipients"`
+	DeliveryID string          `json:"delivery_id,omitempty"` // lets the receiver drop retried duplicates
+}
+
+// DeliveryError reports a peer server rejecting a delivery
+type DeliveryError struct {
+	Server     string
+	StatusCode int
+	Reason     string
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("delivery to %s rejected: %d %s: %s", e.Server, e.StatusCode, http.StatusText(e.StatusCode), e.Reason)
+}
+
+// IsPermanent reports whether err means retrying the delivery cannot succeed
+func IsPermanent(err error) bool {
+	var de *DeliveryError
+	if !errors.As(err, &de) {
+		return false
+	}
+	if de.StatusCode == http.StatusRequestTimeout || de.StatusCode == http.StatusTooManyRequests {
+		return false
+	}
+	return de.StatusCode >= 400 && de.StatusCode < 500
+}
+
+// Sender delivers messages to remote EMSG servers
+type Sender struct {
+	Client       *http.Client
+	LocalDomains []string
+}
+
+// NewSender creates a Sender that treats localDomains as handled by this daemon
+func NewSender(localDomains []string) *Sender {
+	return &Sender{
+		Client:       &http.Client{Timeout: 30 * time.Second},
+		LocalDomains: localDomains,
+	}
+}
+
+// Send posts a single envelope to a remote server
+func (s *Sender) Send(server string, env *Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimRight(server, "/") + InboundPath
+	resp, err := s.Client.Post(endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("delivery to %s failed: %w", server, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &DeliveryError{Server: server, StatusCode: resp.StatusCode, Reason: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// KeyResolver looks up the public key a remote sender signs messages with
+type KeyResolver interface {
+	ResolveKey(address string) (ed25519.PublicKey, error)
+}
+
+// DNSKeyResolver resolves sender keys through the sender domain's _emsg TXT record:
+// it asks the advertised server's user API first and falls back to the record's pubkey field
+type DNSKeyResolver struct {
+	Client *http.Client
+}
+
+// NewDNSKeyResolver creates a DNSKeyResolver with a default HTTP client
+func NewDNSKeyResolver() *DNSKeyResolver {
+	return &DNSKeyResolver{Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// ResolveKey returns the public key for address
+func (r *DNSKeyResolver) ResolveKey(address string) (ed25519.PublicKey, error) {
+	routeInfo, err := router.GetRouteInfo(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var lookupErr error
+	if routeInfo.Server != "" {
+		key, err := r.fetchUserKey(routeInfo.Server, address)
+		if err == nil {
+			return key, nil
+		}
+		lookupErr = err
+	}
+
+	if routeInfo.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(routeInfo.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid pubkey in _emsg record for %s", address)
+		}
+		return ed25519.PublicKey(key), nil
+	}
+
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	return nil, fmt.Errorf("no public key published for %s", address)
+}
+
+// fetchUserKey queries a remote server's user API for an address's public key
+func (r *DNSKeyResolver) fetchUserKey(server, address string) (ed25519.PublicKey, error) {
+	endpoint := strings.TrimRight(server, "/") + "/api/user?address=" + url.QueryEscape(address)
+	resp, err := r.Client.Get(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("user lookup for %s failed: %w", address, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user lookup for %s failed: %s", address, resp.Status)
+	}
+
+	var user auth.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("user lookup for %s returned invalid data: %w", address, err)
+	}
+	if len(user.PubKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("user lookup for %s returned invalid public key", address)
+	}
+	return user.PubKey, nil
+}
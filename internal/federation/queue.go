@@ -0,0 +1,184 @@
+// queue.go
+// Background worker draining the persistent outbound queue
+package federation
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/router"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+
+	"go.etcd.io/bbolt"
+)
+
+// Default retry schedule for outbound deliveries
+const (
+	DefaultPollInterval = 5 * time.Second
+	DefaultBaseDelay    = 30 * time.Second
+	DefaultMaxDelay     = time.Hour
+	DefaultMaxAge       = 72 * time.Hour
+)
+
+// Enqueue queues msg for delivery to remote recipients, one queue entry per destination domain.
+// trackingID names the delivery record updated with the outcome ("" if untracked).
+func Enqueue(db *bbolt.DB, msg *message.Message, recipients []string, trackingID string) error {
+	byDomain := make(map[string][]string)
+	var domains []string
+	for _, recipient := range recipients {
+		domain := router.DomainOf(recipient)
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], recipient)
+	}
+	for _, domain := range domains {
+		item := &storage.OutboundItem{TrackingID: trackingID, Domain: domain, Recipients: byDomain[domain], Message: *msg}
+		if err := storage.EnqueueOutboundBolt(db, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Worker retries queued deliveries with exponential backoff until they are
+// accepted, rejected permanently, or older than MaxAge
+type Worker struct {
+	DB           *bbolt.DB
+	Sender       *Sender
+	Route        func(recipients []string) (map[string][]string, error)
+	PollInterval time.Duration
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	MaxAge       time.Duration
+}
+
+// NewWorker creates a Worker with the default retry schedule
+func NewWorker(db *bbolt.DB, sender *Sender) *Worker {
+	return &Worker{
+		DB:           db,
+		Sender:       sender,
+		Route:        router.RouteMessage,
+		PollInterval: DefaultPollInterval,
+		BaseDelay:    DefaultBaseDelay,
+		MaxDelay:     DefaultMaxDelay,
+		MaxAge:       DefaultMaxAge,
+	}
+}
+
+// Run processes the queue every PollInterval until stop is closed
+func (w *Worker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		w.ProcessDue(time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue attempts every delivery that is due at now
+func (w *Worker) ProcessDue(now time.Time) {
+	items, err := storage.DueOutboundBolt(w.DB, now)
+	if err != nil {
+		log.Printf("outbound queue: %v", err)
+		return
+	}
+	for i := range items {
+		w.attempt(&items[i], now)
+	}
+	if err := storage.PruneReceivedDeliveriesBolt(w.DB, now.Add(-2*w.MaxAge)); err != nil {
+		log.Printf("outbound queue: pruning received deliveries: %v", err)
+	}
+}
+
+// attempt sends one queued delivery and records the outcome
+func (w *Worker) attempt(item *storage.OutboundItem, now time.Time) {
+	err := w.send(item)
+	if err == nil {
+		if err := storage.RemoveOutboundBolt(w.DB, item.ID); err != nil {
+			log.Printf("outbound queue: %v", err)
+		}
+		w.setStatus(item, storage.DeliveryDelivered, "")
+		return
+	}
+
+	item.Attempts++
+	item.LastError = err.Error()
+	age := now.Sub(time.Unix(item.CreatedAt, 0))
+	if IsPermanent(err) || age >= w.MaxAge {
+		log.Printf("outbound queue: giving up on %s to %s after %d attempts: %v", item.ID, item.Domain, item.Attempts, err)
+		if err := storage.DeadLetterOutboundBolt(w.DB, item); err != nil {
+			log.Printf("outbound queue: %v", err)
+		}
+		w.setStatus(item, storage.DeliveryFailed, item.LastError)
+		w.bounce(item)
+		return
+	}
+
+	item.NextAttempt = now.Add(Backoff(item.Attempts, w.BaseDelay, w.MaxDelay)).Unix()
+	if err := storage.UpdateOutboundBolt(w.DB, item); err != nil {
+		log.Printf("outbound queue: %v", err)
+	}
+	w.setStatus(item, storage.DeliveryDeferred, item.LastError)
+}
+
+// setStatus records the outcome of a delivery attempt on the message's delivery record
+func (w *Worker) setStatus(item *storage.OutboundItem, state, reason string) {
+	if item.TrackingID == "" {
+		return
+	}
+	if err := storage.UpdateDeliveryStatusBolt(w.DB, item.TrackingID, item.Recipients, state, reason); err != nil {
+		log.Printf("outbound queue: %v", err)
+	}
+}
+
+// bounce notifies the author of a message that delivery has permanently failed.
+// Only local users are told: a remote author's relayed post has no mailbox here,
+// and system messages are never bounced.
+func (w *Worker) bounce(item *storage.OutboundItem) {
+	from := item.Message.From
+	if system.IsAddress(from) || !router.IsLocalDomain(router.DomainOf(from), w.Sender.LocalDomains) {
+		return
+	}
+	notice := system.NewBounceMessage(&item.Message, item.Recipients, item.LastError)
+	if err := storage.StoreMessageBolt(w.DB, notice); err != nil {
+		log.Printf("outbound queue: storing bounce for %s: %v", item.ID, err)
+	}
+}
+
+// send resolves the destination server and posts the delivery to it
+func (w *Worker) send(item *storage.OutboundItem) error {
+	routes, err := w.Route(item.Recipients)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("no route for %s", item.Domain)
+	}
+	for server, recipients := range routes {
+		env := &Envelope{Message: item.Message, Recipients: recipients, DeliveryID: item.ID}
+		if err := w.Sender.Send(server, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backoff returns the delay before retry number attempts: base doubled per attempt, capped at max
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	return delay
+}
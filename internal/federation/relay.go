@@ -0,0 +1,95 @@
+// relay.go
+// Confirmation of group deliveries relayed by a group's home server
+package federation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/router"
+)
+
+// RelayPath is the endpoint a server confirms the deliveries it is sending on
+const RelayPath = "/api/federation/relay"
+
+// ErrRelayNotFound is returned when the home server is not sending the delivery
+var ErrRelayNotFound = errors.New("delivery not confirmed by the group's home server")
+
+// RelayVerifier asks a group's home server about a delivery it claims to be
+// sending. Envelopes are not signed, so this is how a receiver learns that
+// recipients the message does not name really are members of the group.
+type RelayVerifier interface {
+	// ConfirmRelay asks the home server of groupID whether it is sending env to
+	// domain. It returns ErrRelayNotFound when it is not.
+	ConfirmRelay(groupID, domain string, env *Envelope) error
+}
+
+// RelayDigest identifies what a delivery carries: the signed message and the
+// recipients it is delivered to, in any order. The confirmation endpoint only
+// compares digests, so it never reveals a delivery to whoever asks about it.
+func RelayDigest(msg *message.Message, recipients []string) string {
+	sorted := append([]string{}, recipients...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	h.Write(msg.CanonicalBytes())
+	fmt.Fprintf(h, "\n%s\n%s", msg.Signature, strings.Join(sorted, "\n"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HTTPRelayVerifier confirms relays with the home server's RelayPath endpoint
+type HTTPRelayVerifier struct {
+	Client *http.Client
+	Server func(groupID string) (string, error) // home server URL of a group
+}
+
+// NewRelayVerifier creates an HTTPRelayVerifier that finds home servers through DNS
+func NewRelayVerifier() *HTTPRelayVerifier {
+	return &HTTPRelayVerifier{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Server: func(groupID string) (string, error) {
+			routeInfo, err := router.GetRouteInfo(groupID)
+			if err != nil {
+				return "", err
+			}
+			if routeInfo.Server == "" {
+				return "", fmt.Errorf("no server published for %s", groupID)
+			}
+			return routeInfo.Server, nil
+		},
+	}
+}
+
+// ConfirmRelay asks the home server of groupID whether it is sending env to domain
+func (v *HTTPRelayVerifier) ConfirmRelay(groupID, domain string, env *Envelope) error {
+	server, err := v.Server(groupID)
+	if err != nil {
+		return err
+	}
+	query := url.Values{
+		"id":     {env.DeliveryID},
+		"domain": {domain},
+		"digest": {RelayDigest(&env.Message, env.Recipients)},
+	}
+	resp, err := v.Client.Get(strings.TrimRight(server, "/") + RelayPath + "?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("relay confirmation from %s failed: %w", server, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrRelayNotFound
+	default:
+		return fmt.Errorf("relay confirmation from %s failed: %s", server, resp.Status)
+	}
+}
@@ -4,16 +4,62 @@ package group
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
+)
+
+// Membership errors
+var (
+	ErrAlreadyMember = errors.New("user already in group")
+	ErrNotMember     = errors.New("user not found in group")
 )
 
 type Group struct {
 	ID          string
-	Members     []string // user addresses
-	Admins      []string // admin addresses
-	Name        string   // group_name
-	Description string   // group_description
-	DisplayPic  string   // group_display_picture (URL or hash)
+	Members     []string          // user addresses
+	Admins      []string          // admin addresses
+	Name        string            // group_name
+	Description string            // group_description
+	DisplayPic  string            // group_display_picture (URL or hash)
+	CreatedBy   string            // address of the creator, the initial owner
+	Roles       map[string]string // owner, moderator and read-only members; see Role
+	Permissions Permissions       // roles granted each permission; nil means DefaultPermissions
+	Visibility  string            // VisibilityPublic or VisibilityPrivate; empty means private
+	History     string            // HistoryShared or HistorySinceJoined; empty means shared
+	JoinedAt    map[string]int64  // Unix time each member was added by AddMember
+	Archived    bool              // read-only: no posts, members or changes until unarchived
+	Version     int64             // bumped by storage each time the group is saved with a change
+	Sink        EventSink         `json:"-"` // receives the system events of mutations; nil discards them
+	Changes     []Change          `json:"-"` // settings changed since the group was loaded, for the audit trail
+}
+
+// Change records one edit of a group setting: the field, as named by the API, and its old and new values
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Group visibility. Anyone may join a public group; joining a private group takes
+// an invite or an approved join request.
+const (
+	VisibilityPrivate = "private"
+	VisibilityPublic  = "public"
+)
+
+// Group history settings: whether members see messages sent before they joined
+const (
+	HistoryShared      = "shared"
+	HistorySinceJoined = "since_joined"
+)
+
+// EventSink receives the system events emitted by group mutations. It is injected
+// by the caller so the group package does not depend on storage or delivery.
+type EventSink interface {
+	// GroupEvent is called after g has changed; user is the affected address, if any
+	GroupEvent(g *Group, event, user string)
 }
 
 // NewGroup creates a new group with given metadata and members
@@ -21,6 +67,46 @@ func NewGroup(id, name, description, displayPic string, members []string) *Group
 	return &Group{ID: id, Name: name, Description: description, DisplayPic: displayPic, Members: members}
 }
 
+// IsMember reports whether address belongs to the group
+func (g *Group) IsMember(address string) bool {
+	for _, m := range g.Members {
+		if m == address {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether address administers the group
+func (g *Group) IsAdmin(address string) bool {
+	for _, a := range g.Admins {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPublic reports whether anyone may join the group without approval
+func (g *Group) IsPublic() bool {
+	return g.Visibility == VisibilityPublic
+}
+
+// NotifyCreated emits the group created event on behalf of creator
+func (g *Group) NotifyCreated(creator string) {
+	g.emit(SystemGroupCreated, creator)
+}
+
+// NotifyJoinRequested emits the event asking the admins to approve address
+func (g *Group) NotifyJoinRequested(address string) {
+	g.emit(SystemJoinRequested, address)
+}
+
+// NotifyJoinRejected emits the event telling address its join request was rejected
+func (g *Group) NotifyJoinRejected(address string) {
+	g.emit(SystemJoinRejected, address)
+}
+
 // AddAdmin assigns admin rights to a user and triggers a system message
 func (g *Group) AddAdmin(address string) {
 	for _, a := range g.Admins {
@@ -29,15 +115,21 @@ func (g *Group) AddAdmin(address string) {
 		}
 	}
 	g.Admins = append(g.Admins, address)
-	SendSystemMessage(SystemAdminAssigned, g.ID, address)
+	if g.Roles[address] != RoleOwner {
+		delete(g.Roles, address) // admin replaces a moderator or read-only role
+	}
+	g.emit(SystemAdminAssigned, address)
 }
 
 // RemoveAdmin revokes admin rights from a user and triggers a system message
 func (g *Group) RemoveAdmin(address string) {
 	for i, a := range g.Admins {
 		if a == address {
+			wasOwner := g.Roles[address] == RoleOwner
 			g.Admins = append(g.Admins[:i], g.Admins[i+1:]...)
-			SendSystemMessage(SystemAdminRevoked, g.ID, address)
+			delete(g.Roles, address) // an owner stops being owner too
+			g.emit(SystemAdminRevoked, address)
+			g.succeed(address, true, wasOwner)
 			return
 		}
 	}
@@ -45,13 +137,20 @@ func (g *Group) RemoveAdmin(address string) {
 
 // AddMember adds a user to the group and triggers a system message
 func (g *Group) AddMember(address string) error {
+	if g.Archived {
+		return ErrArchived
+	}
 	for _, m := range g.Members {
 		if m == address {
-			return errors.New("user already in group")
+			return ErrAlreadyMember
 		}
 	}
 	g.Members = append(g.Members, address)
-	SendSystemMessage(SystemUserJoined, g.ID, address)
+	if g.JoinedAt == nil {
+		g.JoinedAt = make(map[string]int64)
+	}
+	g.JoinedAt[address] = time.Now().Unix()
+	g.emit(SystemUserJoined, address)
 	return nil
 }
 
@@ -59,42 +158,98 @@ func (g *Group) AddMember(address string) error {
 func (g *Group) RemoveMember(address string) error {
 	for i, m := range g.Members {
 		if m == address {
+			wasAdmin, wasOwner := g.IsAdmin(address), g.Roles[address] == RoleOwner
 			g.Members = append(g.Members[:i], g.Members[i+1:]...)
-			SendSystemMessage(SystemUserLeft, g.ID, address)
+			g.dropPrivileges(address)
+			delete(g.JoinedAt, address)
+			g.emit(SystemUserLeft, address)
+			g.succeed(address, wasAdmin, wasOwner)
 			return nil
 		}
 	}
-	return errors.New("user not found in group")
+	return ErrNotMember
 }
 
 // RemoveUserByAdmin removes a user by admin action and triggers a system message
 func (g *Group) RemoveUserByAdmin(address string) error {
 	for i, m := range g.Members {
 		if m == address {
+			wasAdmin, wasOwner := g.IsAdmin(address), g.Roles[address] == RoleOwner
 			g.Members = append(g.Members[:i], g.Members[i+1:]...)
-			SendSystemMessage(SystemUserRemoved, g.ID, address)
+			g.dropPrivileges(address)
+			delete(g.JoinedAt, address)
+			g.emit(SystemUserRemoved, address)
+			g.succeed(address, wasAdmin, wasOwner)
 			return nil
 		}
 	}
-	return errors.New("user not found in group")
+	return ErrNotMember
 }
 
 // UpdateName updates the group's name and triggers a system message
 func (g *Group) UpdateName(newName string) {
+	g.record("name", g.Name, newName)
 	g.Name = newName
-	SendSystemMessage(SystemGroupRenamed, g.ID, "")
+	g.emit(SystemGroupRenamed, "")
 }
 
 // UpdateDescription updates the group's description and triggers a system message
 func (g *Group) UpdateDescription(newDesc string) {
+	g.record("description", g.Description, newDesc)
 	g.Description = newDesc
-	SendSystemMessage(SystemDescriptionUpdated, g.ID, "")
+	g.emit(SystemDescriptionUpdated, "")
+}
+
+// UpdatePermissions replaces the group's permission matrix and triggers a system message
+func (g *Group) UpdatePermissions(perms Permissions) error {
+	if err := perms.Validate(); err != nil {
+		return err
+	}
+	before, _ := json.Marshal(g.Permissions)
+	after, _ := json.Marshal(perms)
+	g.record("permissions", string(before), string(after))
+	g.Permissions = perms
+	g.emit(SystemPermissionsUpdated, "")
+	return nil
+}
+
+// UpdateVisibility makes the group public or private and triggers a system message
+func (g *Group) UpdateVisibility(visibility string) error {
+	if visibility != VisibilityPublic && visibility != VisibilityPrivate {
+		return fmt.Errorf("unknown visibility: %s", visibility)
+	}
+	g.record("visibility", g.Visibility, visibility)
+	g.Visibility = visibility
+	g.emit(SystemVisibilityChanged, "")
+	return nil
+}
+
+// UpdateHistory sets whether members see messages sent before they joined and triggers a system message
+func (g *Group) UpdateHistory(history string) error {
+	if history != HistoryShared && history != HistorySinceJoined {
+		return fmt.Errorf("unknown history setting: %s", history)
+	}
+	g.record("history", g.History, history)
+	g.History = history
+	g.emit(SystemHistoryChanged, "")
+	return nil
+}
+
+// HistoryStart returns the Unix time from which address may read the group's
+// messages: 0 for all of them, or when it joined if history is since_joined.
+// Members added when the group was created have no join time and see everything.
+func (g *Group) HistoryStart(address string) int64 {
+	if g.History != HistorySinceJoined {
+		return 0
+	}
+	return g.JoinedAt[address]
 }
 
 // UpdateDisplayPic updates the group's display picture and triggers a system message
 func (g *Group) UpdateDisplayPic(newDP string) {
+	g.record("display_pic", g.DisplayPic, newDP)
 	g.DisplayPic = newDP
-	SendSystemMessage(SystemDPUpdated, g.ID, "")
+	g.emit(SystemDPUpdated, "")
 }
 
 // Persist group state using storage.go
@@ -113,19 +268,78 @@ func LoadGroup(db *sql.DB, id string) (*Group, error) {
 
 // System message constants
 const (
-	SystemAdminAssigned      = "system_admin_assigned"
-	SystemAdminRevoked       = "system_admin_revoked"
-	SystemUserJoined         = "system_user_joined"
-	SystemUserLeft           = "system_user_left"
-	SystemUserRemoved        = "system_user_removed"
-	SystemGroupRenamed       = "system_group_renamed"
-	SystemDescriptionUpdated = "system_description_updated"
-	SystemDPUpdated          = "system_dp_updated"
+	SystemGroupCreated         = "system_group_created"
+	SystemAdminAssigned        = "system_admin_assigned"
+	SystemAdminRevoked         = "system_admin_revoked"
+	SystemUserJoined           = "system_user_joined"
+	SystemUserLeft             = "system_user_left"
+	SystemUserRemoved          = "system_user_removed"
+	SystemGroupRenamed         = "system_group_renamed"
+	SystemDescriptionUpdated   = "system_description_updated"
+	SystemDPUpdated            = "system_dp_updated"
+	SystemRoleChanged          = "system_role_changed"
+	SystemPermissionsUpdated   = "system_permissions_updated"
+	SystemVisibilityChanged    = "system_visibility_changed"
+	SystemHistoryChanged       = "system_history_changed"
+	SystemGroupArchived        = "system_group_archived"
+	SystemGroupUnarchived      = "system_group_unarchived"
+	SystemGroupDeleted         = "system_group_deleted"
+	SystemOwnershipTransferred = "system_ownership_transferred"
+	SystemJoinRequested        = "system_join_requested"
+	SystemJoinRejected         = "system_join_rejected"
 )
 
-// SendSystemMessage is a stub for sending system messages to a group
-func SendSystemMessage(groupID, event, message string) error {
-	// TODO: Implement system message sending logic
-	// This should call system.SendSystemMessage but we avoid import cycle for now
-	return nil
+// EventBuffer is an EventSink that holds events until they are flushed, so that
+// they are only delivered once the change that caused them has been saved
+type EventBuffer struct {
+	events []bufferedEvent
+}
+
+type bufferedEvent struct {
+	group Group
+	event string
+	user  string
+}
+
+// GroupEvent records the event with a snapshot of g as it was when the event fired
+func (b *EventBuffer) GroupEvent(g *Group, event, user string) {
+	snapshot := *g
+	snapshot.Members = append([]string{}, g.Members...)
+	snapshot.Admins = append([]string{}, g.Admins...)
+	snapshot.Sink = nil
+	b.events = append(b.events, bufferedEvent{group: snapshot, event: event, user: user})
+}
+
+// Flush delivers the buffered events to sink in order and empties the buffer
+func (b *EventBuffer) Flush(sink EventSink) {
+	for i := range b.events {
+		sink.GroupEvent(&b.events[i].group, b.events[i].event, b.events[i].user)
+	}
+	b.events = nil
+}
+
+// dropPrivileges removes admin rights and any other role without an event; used
+// when the user leaves the group or is given a lesser role
+func (g *Group) dropPrivileges(address string) {
+	delete(g.Roles, address)
+	for i, a := range g.Admins {
+		if a == address {
+			g.Admins = append(g.Admins[:i], g.Admins[i+1:]...)
+			return
+		}
+	}
+}
+
+// emit reports a system event to the group's sink, if any
+func (g *Group) emit(event, user string) {
+	if g.Sink != nil {
+		g.Sink.GroupEvent(g, event, user)
+	}
+}
+
+// record notes a settings change for the audit trail, skipping no-op writes
+func (g *Group) record(field, old, new string) {
+	if old != new {
+		g.Changes = append(g.Changes, Change{Field: field, Old: old, New: new})
+	}
 }
@@ -0,0 +1,87 @@
+// lifecycle.go
+// Group archival, deletion and ownership succession
+package group
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrArchived is returned when changing an archived group
+var ErrArchived = errors.New("group is archived")
+
+// Owner returns the address holding the owner role, or "" if there is none
+func (g *Group) Owner() string {
+	for _, m := range g.Members {
+		if g.Roles[m] == RoleOwner {
+			return m
+		}
+	}
+	return ""
+}
+
+// SetArchived makes the group read-only, or writable again, and triggers a system message
+func (g *Group) SetArchived(archived bool) {
+	if g.Archived == archived {
+		return
+	}
+	g.record("archived", fmt.Sprint(g.Archived), fmt.Sprint(archived))
+	g.Archived = archived
+	if archived {
+		g.emit(SystemGroupArchived, "")
+	} else {
+		g.emit(SystemGroupUnarchived, "")
+	}
+}
+
+// NotifyDeleted emits the group deleted event on behalf of actor
+func (g *Group) NotifyDeleted(actor string) {
+	g.emit(SystemGroupDeleted, actor)
+}
+
+// TransferOwnership makes a member the owner; the previous owner remains an admin
+func (g *Group) TransferOwnership(address string) error {
+	if !g.IsMember(address) {
+		return ErrNotMember
+	}
+	previous := g.Owner()
+	if previous == address {
+		return nil
+	}
+	if previous != "" {
+		delete(g.Roles, previous)
+	}
+	g.makeOwner(address)
+	return nil
+}
+
+// succeed keeps the group administered after address leaves or loses admin
+// rights: if no admin remains the oldest other member becomes owner, and if the
+// owner went the longest-serving admin takes over
+func (g *Group) succeed(address string, wasAdmin, wasOwner bool) {
+	if !wasAdmin && !wasOwner {
+		return
+	}
+	if len(g.Admins) == 0 {
+		for _, m := range g.Members { // members are kept in joining order
+			if m != address {
+				g.makeOwner(m)
+				return
+			}
+		}
+	} else if wasOwner && g.Owner() == "" {
+		g.makeOwner(g.Admins[0])
+	}
+}
+
+// makeOwner gives address the owner role, which is always also an admin
+func (g *Group) makeOwner(address string) {
+	if g.Roles == nil {
+		g.Roles = make(map[string]string)
+	}
+	g.Roles[address] = RoleOwner
+	if !g.IsAdmin(address) {
+		g.Admins = append(g.Admins, address)
+	}
+	g.emit(SystemOwnershipTransferred, address)
+}
@@ -0,0 +1,171 @@
+// roles.go
+// Group roles and the per-group permission matrix
+package group
+
+import (
+	"fmt"
+)
+
+// Roles, from most to least privileged. Admins are listed in Group.Admins; the
+// other roles are kept in Group.Roles, and members without an entry are RoleMember.
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleReadOnly  = "read_only"
+)
+
+// Permissions that can be granted to roles
+const (
+	PermPost           = "post"            // send messages to the group
+	PermInvite         = "invite"          // add members
+	PermRemove         = "remove"          // remove members of a lower role
+	PermEditMetadata   = "edit_metadata"   // change name, description and display picture
+	PermDeleteMessages = "delete_messages" // delete other members' messages
+)
+
+// Permission presets
+const (
+	PresetDefault      = "default"
+	PresetAnnouncement = "announcement" // only owners and admins post
+)
+
+// Permissions maps each permission to the roles granted it
+type Permissions map[string][]string
+
+// roleRank orders roles for comparisons; higher outranks lower
+var roleRank = map[string]int{
+	RoleReadOnly:  1,
+	RoleMember:    2,
+	RoleModerator: 3,
+	RoleAdmin:     4,
+	RoleOwner:     5,
+}
+
+// DefaultPermissions is the matrix of a group with no explicit permissions
+func DefaultPermissions() Permissions {
+	return Permissions{
+		PermPost:           {RoleOwner, RoleAdmin, RoleModerator, RoleMember},
+		PermInvite:         {RoleOwner, RoleAdmin, RoleModerator},
+		PermRemove:         {RoleOwner, RoleAdmin, RoleModerator},
+		PermEditMetadata:   {RoleOwner, RoleAdmin},
+		PermDeleteMessages: {RoleOwner, RoleAdmin, RoleModerator},
+	}
+}
+
+// PresetPermissions returns the matrix for a named preset
+func PresetPermissions(preset string) (Permissions, error) {
+	perms := DefaultPermissions()
+	switch preset {
+	case PresetDefault, "":
+	case PresetAnnouncement:
+		perms[PermPost] = []string{RoleOwner, RoleAdmin}
+	default:
+		return nil, fmt.Errorf("unknown permission preset: %s", preset)
+	}
+	return perms, nil
+}
+
+// Validate checks that a matrix only names known permissions and roles
+func (p Permissions) Validate() error {
+	defaults := DefaultPermissions()
+	for perm, roles := range p {
+		if _, ok := defaults[perm]; !ok {
+			return fmt.Errorf("unknown permission: %s", perm)
+		}
+		for _, role := range roles {
+			if _, ok := roleRank[role]; !ok {
+				return fmt.Errorf("unknown role: %s", role)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidRole reports whether role is one of the group roles
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// Outranks reports whether role a is more privileged than role b
+func Outranks(a, b string) bool {
+	return roleRank[a] > roleRank[b]
+}
+
+// Role returns the role of address in the group, or "" if it is not a member
+func (g *Group) Role(address string) string {
+	if !g.IsMember(address) {
+		return ""
+	}
+	if g.Roles[address] == RoleOwner {
+		return RoleOwner
+	}
+	if g.IsAdmin(address) {
+		return RoleAdmin
+	}
+	if role, ok := g.Roles[address]; ok {
+		return role
+	}
+	return RoleMember
+}
+
+// Can reports whether address holds a role granted perm in this group
+func (g *Group) Can(address, perm string) bool {
+	role := g.Role(address)
+	if role == "" {
+		return false
+	}
+	perms := g.Permissions
+	if perms == nil {
+		perms = DefaultPermissions()
+	}
+	for _, granted := range perms[perm] {
+		if granted == role {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRole gives a member a new role and triggers a system message. The owner
+// role is always also an admin; any other role change drops admin rights.
+func (g *Group) SetRole(address, role string) error {
+	if !g.IsMember(address) {
+		return ErrNotMember
+	}
+	if !ValidRole(role) {
+		return fmt.Errorf("unknown role: %s", role)
+	}
+	if g.Role(address) == role {
+		return nil
+	}
+
+	if g.Roles == nil {
+		g.Roles = make(map[string]string)
+	}
+	wasAdmin, wasOwner := g.IsAdmin(address), g.Roles[address] == RoleOwner
+	switch role {
+	case RoleOwner:
+		g.Roles[address] = RoleOwner
+		if !g.IsAdmin(address) {
+			g.Admins = append(g.Admins, address)
+		}
+	case RoleAdmin:
+		delete(g.Roles, address)
+		if !g.IsAdmin(address) {
+			g.Admins = append(g.Admins, address)
+		}
+	default:
+		g.dropPrivileges(address)
+		if role != RoleMember {
+			g.Roles[address] = role
+		}
+	}
+	g.emit(SystemRoleChanged, address)
+	if role != RoleOwner && role != RoleAdmin {
+		g.succeed(address, wasAdmin, wasOwner)
+	}
+	return nil
+}
@@ -3,65 +3,245 @@
 package message
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"strconv"
+	"time"
 
-	"emsg-daemon/internal/group"
 	"emsg-daemon/internal/auth"
+	"emsg-daemon/internal/group"
 )
 
 type Message struct {
+	ID        string   `json:"id"`
 	From      string   `json:"from"`
 	To        []string `json:"to"`
 	CC        []string `json:"cc"`
 	GroupID   string   `json:"group_id"`
 	Body      string   `json:"body"`
+	SentAt    int64    `json:"sent_at"` // Unix timestamp
 	Signature string   `json:"signature"`
 }
 
 // Validate checks if the message has required fields
 func (m *Message) Validate() error {
-	if m.From == "" || len(m.To) == 0 || m.Body == "" {
+	// Group messages are addressed by group_id; their recipients are the group's members
+	if m.From == "" || (len(m.To) == 0 && m.GroupID == "") || m.Body == "" {
 		return errors.New("missing required fields: from, to, or body")
 	}
+	if m.ID != "" && !ValidID(m.ID) {
+		return errors.New("invalid message id: must be 32 lowercase hex characters")
+	}
 	return nil
 }
 
-// Verify checks the message signature using the sender's public key
+// NewID generates a time-ordered message ID: the creation time in Unix nanoseconds
+// as 16 hex digits followed by 16 random hex digits. IDs sort by creation time.
+func NewID(t time.Time) string {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], uint64(t.UnixNano()))
+	rand.Read(buf[8:])
+	return hex.EncodeToString(buf)
+}
+
+// ValidID reports whether id has the format produced by NewID
+func ValidID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxClockSkew is how far a client-set sent_at may be from the server's clock
+const MaxClockSkew = 5 * time.Minute
+
+// IDTime returns the creation time encoded in an ID produced by NewID
+func IDTime(id string) (time.Time, error) {
+	if !ValidID(id) {
+		return time.Time{}, errors.New("invalid message id: must be 32 lowercase hex characters")
+	}
+	buf, _ := hex.DecodeString(id[:16])
+	return time.Unix(0, int64(binary.BigEndian.Uint64(buf))), nil
+}
+
+// CheckTimes reports whether the message's ID and sent_at agree with each other
+// and lie within MaxClockSkew of now, so clients cannot reorder mailboxes
+func (m *Message) CheckTimes(now time.Time) error {
+	if err := m.CheckFederatedTimes(now); err != nil {
+		return err
+	}
+	if time.Unix(m.SentAt, 0).Before(now.Add(-MaxClockSkew)) {
+		return errors.New("sent_at is too far from the server time")
+	}
+	return nil
+}
+
+// CheckFederatedTimes is CheckTimes for messages from other servers, which may
+// have waited in a delivery queue: sent_at may lie arbitrarily far in the past
+func (m *Message) CheckFederatedTimes(now time.Time) error {
+	created, err := IDTime(m.ID)
+	if err != nil {
+		return err
+	}
+	if created.Unix() != m.SentAt {
+		return errors.New("id does not encode sent_at")
+	}
+	if time.Unix(m.SentAt, 0).After(now.Add(MaxClockSkew)) {
+		return errors.New("sent_at is too far from the server time")
+	}
+	return nil
+}
+
+// Recipients returns the distinct To and CC addresses of the message
+func (m *Message) Recipients() []string {
+	seen := make(map[string]struct{})
+	var addrs []string
+	for _, addr := range append(append([]string{}, m.To...), m.CC...) {
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// AssignID gives the message a server-assigned ID and sent timestamp if the client did not supply them
+func (m *Message) AssignID(now time.Time) {
+	if m.ID == "" {
+		m.ID = NewID(now)
+	}
+	if m.SentAt == 0 {
+		m.SentAt = now.Unix()
+	}
+}
+
+// canonicalVersion tags the signed byte string so the format can evolve
+const canonicalVersion = "emsg-message-v1"
+
+// CanonicalBytes returns the byte string covered by the message signature. Every
+// field is written as a netstring ("<decimal length>:<bytes>,") in this order:
+// "emsg-message-v1", id, sent_at, from, number of to, each to, number of cc,
+// each cc, group_id, body. Numbers are written in decimal.
+func (m *Message) CanonicalBytes() []byte {
+	var buf bytes.Buffer
+	writeNetstring(&buf, canonicalVersion)
+	writeNetstring(&buf, m.ID)
+	writeNetstring(&buf, strconv.FormatInt(m.SentAt, 10))
+	writeNetstring(&buf, m.From)
+	writeNetstring(&buf, strconv.Itoa(len(m.To)))
+	for _, to := range m.To {
+		writeNetstring(&buf, to)
+	}
+	writeNetstring(&buf, strconv.Itoa(len(m.CC)))
+	for _, cc := range m.CC {
+		writeNetstring(&buf, cc)
+	}
+	writeNetstring(&buf, m.GroupID)
+	writeNetstring(&buf, m.Body)
+	return buf.Bytes()
+}
+
+// Sign signs the canonical envelope with the sender's private key, assigning an
+// ID and sent timestamp first if they are missing
+func (m *Message) Sign(privateKey ed25519.PrivateKey) {
+	m.AssignID(time.Now())
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, m.CanonicalBytes()))
+}
+
+// Verify checks the signature over the canonical envelope using the sender's public key
 func (m *Message) Verify(pubKey []byte) bool {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return false
+	}
 	// Use VerifySignature from auth.go
-	return auth.VerifySignature(pubKey, []byte(m.Body), decodeBase64(m.Signature))
+	return auth.VerifySignature(pubKey, m.CanonicalBytes(), decodeBase64(m.Signature))
 }
 
-// Deliver delivers the message to all recipients and group members
+// writeNetstring appends s to buf as a netstring
+func writeNetstring(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+	buf.WriteByte(',')
+}
+
+// Errors returned by Deliver
+var (
+	ErrUnknownGroup       = errors.New("unknown group")
+	ErrRecipientNotMember = errors.New("group posts may only be addressed to members")
+)
+
+// Deliver returns the distinct addresses the message must be delivered to: its To
+// addresses, its CC addresses with any group among them expanded to its members,
+// and the members of its group. The sender is not delivered their own group posts,
+// and a group post may only name members of the group in To.
 func (m *Message) Deliver(groups map[string]*group.Group) ([]string, error) {
-	delivered := make(map[string]struct{})
-	for _, to := range m.To {
-		delivered[to] = struct{}{}
+	seen := make(map[string]struct{})
+	var recipients []string
+	add := func(addr string) {
+		if _, ok := seen[addr]; !ok {
+			seen[addr] = struct{}{}
+			recipients = append(recipients, addr)
+		}
 	}
-	for _, cc := range m.CC {
-		if group, ok := groups[cc]; ok {
-			for _, member := range group.Members {
-				delivered[member] = struct{}{}
+	addMembers := func(g *group.Group) {
+		for _, member := range g.Members {
+			if member != m.From {
+				add(member)
 			}
-		} else {
-			delivered[cc] = struct{}{}
 		}
 	}
+
+	var g *group.Group
 	if m.GroupID != "" {
-		if group, ok := groups[m.GroupID]; ok {
-			for _, member := range group.Members {
-				delivered[member] = struct{}{}
-			}
+		var ok bool
+		if g, ok = groups[m.GroupID]; !ok {
+			return nil, ErrUnknownGroup
+		}
+		if err := m.CheckGroupRecipients(g); err != nil {
+			return nil, err
 		}
 	}
-	var recipients []string
-	for addr := range delivered {
-		recipients = append(recipients, addr)
+
+	for _, to := range m.To {
+		add(to)
+	}
+	for _, cc := range m.CC {
+		if g, ok := groups[cc]; ok {
+			addMembers(g)
+		} else {
+			add(cc)
+		}
+	}
+	if g != nil {
+		addMembers(g)
 	}
 	return recipients, nil
 }
 
+// CheckGroupRecipients returns ErrRecipientNotMember if the message names anyone
+// in To who is neither a member of g nor g itself
+func (m *Message) CheckGroupRecipients(g *group.Group) error {
+	for _, to := range m.To {
+		if to != g.ID && !g.IsMember(to) {
+			return fmt.Errorf("%w: %s", ErrRecipientNotMember, to)
+		}
+	}
+	return nil
+}
+
 func decodeBase64(s string) []byte {
 	// Helper for base64 decoding
 	b, _ := base64.StdEncoding.DecodeString(s)
@@ -89,6 +89,28 @@ func ValidateAddress(address string) error {
 	return nil
 }
 
+// maxGroupNameLength bounds the name part of a group ID
+const maxGroupNameLength = 64
+
+// ValidateGroupID checks that a group ID is a domain-qualified name#domain.com.
+// The domain names the group's home server; the name may only contain letters,
+// digits, '.', '-' and '_'.
+func ValidateGroupID(id string) error {
+	if err := ValidateAddress(id); err != nil {
+		return fmt.Errorf("invalid group id: %w", err)
+	}
+	name := strings.Split(id, "#")[0]
+	if len(name) > maxGroupNameLength {
+		return fmt.Errorf("group name cannot be longer than %d characters", maxGroupNameLength)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return fmt.Errorf("group name contains invalid character %q", r)
+		}
+	}
+	return nil
+}
+
 // RouteMessage determines where to route a message based on recipient addresses
 func RouteMessage(recipients []string) (map[string][]string, error) {
 	routes := make(map[string][]string) // server -> list of recipients
@@ -122,3 +144,24 @@ func IsLocalDomain(domain string, localDomains []string) bool {
 	}
 	return false
 }
+
+// DomainOf returns the domain part of an EMSG address, or "" if the address is malformed
+func DomainOf(address string) string {
+	parts := strings.Split(address, "#")
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// PartitionRecipients splits recipients into those handled locally and those on remote servers
+func PartitionRecipients(recipients []string, localDomains []string) (local, remote []string) {
+	for _, recipient := range recipients {
+		if IsLocalDomain(DomainOf(recipient), localDomains) {
+			local = append(local, recipient)
+		} else {
+			remote = append(remote, recipient)
+		}
+	}
+	return local, remote
+}
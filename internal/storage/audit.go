@@ -0,0 +1,78 @@
+// audit.go
+// Per-group audit trail of settings changes for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"emsg-daemon/internal/group"
+
+	"go.etcd.io/bbolt"
+)
+
+// GroupChange is one entry of a group's audit trail
+type GroupChange struct {
+	Version   int64  `json:"version"` // group version the change produced
+	Actor     string `json:"actor"`
+	Field     string `json:"field"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+	ChangedAt int64  `json:"changed_at"` // Unix timestamp
+}
+
+// recordChangesTx appends the changes made to grp since it was loaded to its audit trail
+func recordChangesTx(tx *bbolt.Tx, grp *group.Group, actor string) error {
+	if len(grp.Changes) == 0 {
+		return nil
+	}
+	box, err := tx.Bucket(groupAuditBucket).CreateBucketIfNotExists([]byte(grp.ID))
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, c := range grp.Changes {
+		seq, err := box.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := putJSON(box, string(key), GroupChange{
+			Version:   grp.Version,
+			Actor:     actor,
+			Field:     c.Field,
+			Old:       c.Old,
+			New:       c.New,
+			ChangedAt: now,
+		}); err != nil {
+			return err
+		}
+	}
+	grp.Changes = nil
+	return nil
+}
+
+// ListGroupChangesBolt returns the audit trail of a group, oldest first, from the
+// changes that produced versions after since
+func ListGroupChangesBolt(db *bbolt.DB, groupID string, since int64) ([]GroupChange, error) {
+	var changes []GroupChange
+	err := db.View(func(tx *bbolt.Tx) error {
+		box := tx.Bucket(groupAuditBucket).Bucket([]byte(groupID))
+		if box == nil {
+			return nil
+		}
+		return box.ForEach(func(k, v []byte) error {
+			var c GroupChange
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if c.Version > since {
+				changes = append(changes, c)
+			}
+			return nil
+		})
+	})
+	return changes, err
+}
@@ -3,20 +3,39 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"time"
 
-	"go.etcd.io/bbolt"
-	"emsg-daemon/internal/message"
-	"emsg-daemon/internal/group"
 	"emsg-daemon/internal/auth"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+
+	"go.etcd.io/bbolt"
 )
 
 var (
 	messagesBucket = []byte("messages")
 	groupsBucket   = []byte("groups")
 	usersBucket    = []byte("users")
+	outboundBucket = []byte("outbound")
+	deadBucket     = []byte("outbound_dead")
+	receivedBucket = []byte("federation_received")
+	deliveryBucket = []byte("delivery_status")
+	inboxBucket    = []byte("inbox")     // nested: recipient address -> message ID -> sequence number
+	inboxSeqBucket = []byte("inbox_seq") // nested: recipient address -> sequence number -> message ID
+	sentBucket     = []byte("sent")      // nested: sender address -> message ID
+
+	webhooksBucket      = []byte("webhooks") // nested: owner address -> webhook ID
+	webhookQueueBucket  = []byte("webhook_queue")
+	invitesBucket       = []byte("invites")
+	joinRequestsBucket  = []byte("join_requests")        // nested: group ID -> requester address
+	groupTimelineBucket = []byte("group_timeline")       // nested: group ID -> message ID -> time added
+	groupAuditBucket    = []byte("group_audit")          // nested: group ID -> sequence number -> GroupChange
+	metaBucket          = []byte("meta")                 // server-wide settings and secrets
+	remoteMembersBucket = []byte("remote_group_members") // nested: remote group ID -> local member address
 )
 
 // InitBoltDB initializes a BoltDB database
@@ -28,14 +47,46 @@ func InitBoltDB(dataSourceName string) (*bbolt.DB, error) {
 
 	// Create buckets if they don't exist
 	err = db.Update(func(tx *bbolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(messagesBucket); err != nil {
-			return err
+		buckets := [][]byte{
+			messagesBucket, groupsBucket, usersBucket,
+			outboundBucket, deadBucket, receivedBucket, deliveryBucket,
+			webhooksBucket, webhookQueueBucket, invitesBucket, joinRequestsBucket, groupAuditBucket, metaBucket, remoteMembersBucket,
 		}
-		if _, err := tx.CreateBucketIfNotExists(groupsBucket); err != nil {
-			return err
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
 		}
-		if _, err := tx.CreateBucketIfNotExists(usersBucket); err != nil {
-			return err
+
+		// Group timelines are built from the stored messages the first time
+		if tx.Bucket(groupTimelineBucket) == nil {
+			if _, err := tx.CreateBucket(groupTimelineBucket); err != nil {
+				return err
+			}
+			if err := rebuildGroupTimelinesTx(tx); err != nil {
+				return err
+			}
+		}
+
+		// Databases created before the mailbox indexes existed are indexed once here
+		if tx.Bucket(inboxBucket) == nil || tx.Bucket(sentBucket) == nil {
+			tx.DeleteBucket(inboxBucket)
+			tx.DeleteBucket(inboxSeqBucket)
+			tx.DeleteBucket(sentBucket)
+			for _, name := range [][]byte{inboxBucket, inboxSeqBucket, sentBucket} {
+				if _, err := tx.CreateBucket(name); err != nil {
+					return err
+				}
+			}
+			return rebuildMailboxesTx(tx)
+		}
+
+		// Inbox entries stored before sequence numbers existed are numbered once, in ID order
+		if tx.Bucket(inboxSeqBucket) == nil {
+			if _, err := tx.CreateBucket(inboxSeqBucket); err != nil {
+				return err
+			}
+			return sequenceInboxesTx(tx)
 		}
 		return nil
 	})
@@ -43,103 +94,370 @@ func InitBoltDB(dataSourceName string) (*bbolt.DB, error) {
 	return db, err
 }
 
-// StoreMessageBolt stores a message in BoltDB
+// ErrMessageExists is returned when storing a message whose ID is already taken
+var ErrMessageExists = errors.New("message id already exists")
+
+// StoreMessageBolt stores a message in BoltDB, keyed by its time-ordered ID, and
+// indexes it in the mailbox of every To and CC address and the sender's sent mail.
+// Messages without an ID or sent timestamp are assigned one.
 func StoreMessageBolt(db *bbolt.DB, msg *message.Message) error {
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(messagesBucket)
-		
-		// Generate a simple key (could be improved with proper ID generation)
-		key := fmt.Sprintf("%s_%s_%d", msg.From, strings.Join(msg.To, ","), len(msg.Body))
-		
-		data, err := json.Marshal(msg)
-		if err != nil {
+	return DeliverMessageBolt(db, msg, msg.Recipients())
+}
+
+// DeliverMessageBolt stores a message and indexes it in the mailboxes of the given
+// recipients and the sender's sent mail
+func DeliverMessageBolt(db *bbolt.DB, msg *message.Message, recipients []string) error {
+	msg.AssignID(time.Now())
+	err := db.Update(func(tx *bbolt.Tx) error {
+		return storeMessageTx(tx, msg, recipients)
+	})
+	if err != nil {
+		return err
+	}
+	notifyMessageStored(db, msg, recipients)
+	return nil
+}
+
+// DeliverNoticeBolt stores a message about a group that is meant for only some of
+// its members, such as a join request for the admins. It is indexed like
+// DeliverMessageBolt but kept out of the group's timeline.
+func DeliverNoticeBolt(db *bbolt.DB, msg *message.Message, recipients []string) error {
+	msg.AssignID(time.Now())
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if err := putMessageTx(tx, msg); err != nil {
+			return err
+		}
+		if err := indexSentTx(tx, msg); err != nil {
 			return err
 		}
-		
-		return b.Put([]byte(key), data)
+		return indexMessageTx(tx, msg.ID, recipients)
 	})
+	if err != nil {
+		return err
+	}
+	notifyMessageStored(db, msg, recipients)
+	return nil
 }
 
-// GetMessagesByUserBolt retrieves messages for a user from BoltDB
+// storeMessageTx writes a message and its mailbox entries within an open transaction
+func storeMessageTx(tx *bbolt.Tx, msg *message.Message, recipients []string) error {
+	if err := putMessageTx(tx, msg); err != nil {
+		return err
+	}
+	if err := indexSentTx(tx, msg); err != nil {
+		return err
+	}
+	if err := indexGroupTx(tx, msg, time.Now().Unix()); err != nil {
+		return err
+	}
+	return indexMessageTx(tx, msg.ID, recipients)
+}
+
+// putMessageTx writes a message under its ID, refusing to overwrite an existing one
+func putMessageTx(tx *bbolt.Tx, msg *message.Message) error {
+	b := tx.Bucket(messagesBucket)
+	if b.Get([]byte(msg.ID)) != nil {
+		return ErrMessageExists
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(msg.ID), data)
+}
+
+// GetMessageBolt retrieves a message by ID
+func GetMessageBolt(db *bbolt.DB, id string) (*message.Message, error) {
+	var msg message.Message
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(messagesBucket).Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("message not found: %s", id)
+		}
+		return json.Unmarshal(data, &msg)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// DeleteMessageBolt deletes a message, its group timeline entry and its mailbox
+// entries for the sender and its To and CC addresses. Entries left in other mailboxes are skipped on read.
+func DeleteMessageBolt(db *bbolt.DB, id string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return deleteMessageTx(tx, id)
+	})
+}
+
+// deleteMessageTx removes a message and its mailbox and timeline entries
+func deleteMessageTx(tx *bbolt.Tx, id string) error {
+	b := tx.Bucket(messagesBucket)
+	data := b.Get([]byte(id))
+	if data == nil {
+		return fmt.Errorf("message not found: %s", id)
+	}
+	var msg message.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	if box := tx.Bucket(sentBucket).Bucket([]byte(msg.From)); box != nil {
+		if err := box.Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	for _, recipient := range msg.Recipients() {
+		if err := unindexMessageTx(tx, id, recipient); err != nil {
+			return err
+		}
+	}
+	if err := unindexGroupTx(tx, &msg); err != nil {
+		return err
+	}
+	return b.Delete([]byte(id))
+}
+
+// GetMessagesByUserBolt retrieves the messages in a user's mailbox, oldest first
 func GetMessagesByUserBolt(db *bbolt.DB, user string) ([]message.Message, error) {
 	var messages []message.Message
-	
+
 	err := db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(messagesBucket)
-		
-		return b.ForEach(func(k, v []byte) error {
+		box := tx.Bucket(inboxBucket).Bucket([]byte(user))
+		if box == nil {
+			return nil
+		}
+		msgs := tx.Bucket(messagesBucket)
+
+		return box.ForEach(func(k, _ []byte) error {
+			data := msgs.Get(k)
+			if data == nil {
+				return nil
+			}
 			var msg message.Message
-			if err := json.Unmarshal(v, &msg); err != nil {
+			if err := json.Unmarshal(data, &msg); err != nil {
 				return err
 			}
-			
-			// Check if user is in To or CC fields
-			for _, to := range msg.To {
-				if strings.Contains(to, user) {
-					messages = append(messages, msg)
-					return nil
-				}
-			}
-			for _, cc := range msg.CC {
-				if strings.Contains(cc, user) {
-					messages = append(messages, msg)
-					return nil
-				}
-			}
-			
+			messages = append(messages, msg)
 			return nil
 		})
 	})
-	
+
 	return messages, err
 }
 
-// StoreGroupBolt stores a group in BoltDB
+// StoreGroupBolt stores a group in BoltDB, replacing any group with the same ID
 func StoreGroupBolt(db *bbolt.DB, grp *group.Group) error {
 	return db.Update(func(tx *bbolt.Tx) error {
 		b := tx.Bucket(groupsBucket)
-		
+
 		data, err := json.Marshal(grp)
 		if err != nil {
 			return err
 		}
-		
+
 		return b.Put([]byte(grp.ID), data)
 	})
 }
 
+// Group storage errors
+var (
+	ErrGroupNotFound = errors.New("group not found")
+	ErrGroupExists   = errors.New("group id already exists")
+)
+
+// CreateGroupBolt stores a new group, refusing to overwrite an existing one
+func CreateGroupBolt(db *bbolt.DB, grp *group.Group) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(groupsBucket)
+		if b.Get([]byte(grp.ID)) != nil {
+			return fmt.Errorf("%w: %s", ErrGroupExists, grp.ID)
+		}
+		return putJSON(b, grp.ID, grp)
+	})
+}
+
 // GetGroupBolt retrieves a group from BoltDB
 func GetGroupBolt(db *bbolt.DB, id string) (*group.Group, error) {
 	var grp group.Group
-	
+
 	err := db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket(groupsBucket)
-		
+
 		data := b.Get([]byte(id))
 		if data == nil {
-			return fmt.Errorf("group not found: %s", id)
+			return fmt.Errorf("%w: %s", ErrGroupNotFound, id)
 		}
-		
+
 		return json.Unmarshal(data, &grp)
 	})
-	
+
 	if err != nil {
 		return nil, err
 	}
-	
+
 	return &grp, nil
 }
 
+// UpdateGroupBolt loads a group, applies fn and saves the result in a single
+// transaction. If fn fails nothing is saved. The settings fn changes are added to
+// the group's audit trail under actor. The system events fn triggers are
+// delivered to sink (if not nil) only after the change has been committed.
+func UpdateGroupBolt(db *bbolt.DB, id, actor string, sink group.EventSink, fn func(grp *group.Group) error) (*group.Group, error) {
+	var grp *group.Group
+	buffer := &group.EventBuffer{}
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		if grp, err = updateGroupTx(tx, id, buffer, fn); err != nil {
+			return err
+		}
+		return recordChangesTx(tx, grp, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	grp.Sink = sink
+	if sink != nil {
+		buffer.Flush(sink)
+	}
+	return grp, nil
+}
+
+// updateGroupTx applies fn to a stored group within an open transaction, buffering its events
+func updateGroupTx(tx *bbolt.Tx, id string, buffer *group.EventBuffer, fn func(grp *group.Group) error) (*group.Group, error) {
+	b := tx.Bucket(groupsBucket)
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, fmt.Errorf("%w: %s", ErrGroupNotFound, id)
+	}
+	var grp group.Group
+	if err := json.Unmarshal(data, &grp); err != nil {
+		return nil, err
+	}
+
+	grp.Sink = buffer
+	if err := fn(&grp); err != nil {
+		return nil, err
+	}
+	if err := dropJoinRequestsTx(tx, &grp); err != nil {
+		return nil, err
+	}
+
+	updated, err := json.Marshal(&grp)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(updated, data) {
+		return &grp, nil // nothing changed; keep the version
+	}
+	grp.Version++
+	return &grp, putJSON(b, id, &grp)
+}
+
+// DeleteGroupBolt applies fn to a group and then deletes it together with its
+// join requests, invites, audit trail and timeline, in a single transaction.
+// With purge the group's messages are also removed from every mailbox; otherwise
+// members keep their copies. The events fn triggers are delivered to sink after
+// the commit.
+func DeleteGroupBolt(db *bbolt.DB, id string, purge bool, sink group.EventSink, fn func(grp *group.Group) error) (*group.Group, error) {
+	var grp *group.Group
+	buffer := &group.EventBuffer{}
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		if grp, err = updateGroupTx(tx, id, buffer, fn); err != nil {
+			return err
+		}
+		if err := deleteGroupIndexesTx(tx, id, purge); err != nil {
+			return err
+		}
+		return tx.Bucket(groupsBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	grp.Sink = sink
+	if sink != nil {
+		buffer.Flush(sink)
+	}
+	return grp, nil
+}
+
+// deleteGroupIndexesTx removes everything stored alongside a group: its join
+// requests, its invites, its audit trail and its timeline, purging the group's posts if asked
+func deleteGroupIndexesTx(tx *bbolt.Tx, id string, purge bool) error {
+	key := []byte(id)
+	if tx.Bucket(joinRequestsBucket).Bucket(key) != nil {
+		if err := tx.Bucket(joinRequestsBucket).DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+
+	var invites [][]byte
+	err := tx.Bucket(invitesBucket).ForEach(func(k, v []byte) error {
+		var inv Invite
+		if err := json.Unmarshal(v, &inv); err == nil && inv.GroupID == id {
+			invites = append(invites, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range invites {
+		if err := tx.Bucket(invitesBucket).Delete(k); err != nil {
+			return err
+		}
+	}
+
+	if tx.Bucket(groupAuditBucket).Bucket(key) != nil {
+		if err := tx.Bucket(groupAuditBucket).DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+
+	timeline := tx.Bucket(groupTimelineBucket).Bucket(key)
+	if timeline == nil {
+		return nil
+	}
+	if purge {
+		// Messages that only CC'd the group belong to their other recipients too
+		var ids []string
+		msgs := tx.Bucket(messagesBucket)
+		timeline.ForEach(func(k, _ []byte) error {
+			var msg message.Message
+			if err := json.Unmarshal(msgs.Get(k), &msg); err == nil && msg.GroupID == id {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+		for _, msgID := range ids {
+			if err := deleteMessageTx(tx, msgID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(groupTimelineBucket).DeleteBucket(key)
+}
+
 // StoreUserBolt stores a user in BoltDB
 func StoreUserBolt(db *bbolt.DB, user *auth.User) error {
 	return db.Update(func(tx *bbolt.Tx) error {
 		b := tx.Bucket(usersBucket)
-		
+
 		data, err := json.Marshal(user)
 		if err != nil {
 			return err
 		}
-		
+
 		return b.Put([]byte(user.Address), data)
 	})
 }
@@ -147,21 +465,21 @@ func StoreUserBolt(db *bbolt.DB, user *auth.User) error {
 // GetUserBolt retrieves a user from BoltDB
 func GetUserBolt(db *bbolt.DB, address string) (*auth.User, error) {
 	var user auth.User
-	
+
 	err := db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket(usersBucket)
-		
+
 		data := b.Get([]byte(address))
 		if data == nil {
 			return fmt.Errorf("user not found: %s", address)
 		}
-		
+
 		return json.Unmarshal(data, &user)
 	})
-	
+
 	if err != nil {
 		return nil, err
 	}
-	
+
 	return &user, nil
 }
@@ -0,0 +1,105 @@
+// delivery.go
+// Per-recipient delivery status tracking for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Delivery states
+const (
+	DeliveryQueued    = "queued"
+	DeliveryDelivered = "delivered"
+	DeliveryDeferred  = "deferred"
+	DeliveryFailed    = "failed"
+)
+
+// RecipientStatus is the delivery state of a message for one recipient
+type RecipientStatus struct {
+	State     string `json:"state"`
+	Reason    string `json:"reason,omitempty"`
+	UpdatedAt int64  `json:"updated_at"` // Unix timestamp
+}
+
+// DeliveryRecord tracks a submitted message across all of its recipients
+type DeliveryRecord struct {
+	ID         string                      `json:"id"`
+	From       string                      `json:"from"`
+	CreatedAt  int64                       `json:"created_at"` // Unix timestamp
+	Recipients map[string]*RecipientStatus `json:"recipients"`
+}
+
+// CreateDeliveryRecordBolt starts tracking the message with the given ID: local
+// recipients are delivered on submission, remote recipients start out queued
+func CreateDeliveryRecordBolt(db *bbolt.DB, id, from string, local, remote []string) (*DeliveryRecord, error) {
+	now := time.Now().Unix()
+	record := &DeliveryRecord{
+		ID:         id,
+		From:       from,
+		CreatedAt:  now,
+		Recipients: make(map[string]*RecipientStatus),
+	}
+	for _, recipient := range local {
+		record.Recipients[recipient] = &RecipientStatus{State: DeliveryDelivered, UpdatedAt: now}
+	}
+	for _, recipient := range remote {
+		record.Recipients[recipient] = &RecipientStatus{State: DeliveryQueued, UpdatedAt: now}
+	}
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(deliveryBucket), record.ID, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// UpdateDeliveryStatusBolt sets the delivery state for some recipients of a tracked message
+func UpdateDeliveryStatusBolt(db *bbolt.DB, id string, recipients []string, state, reason string) error {
+	var record DeliveryRecord
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(deliveryBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("delivery record not found: %s", id)
+		}
+
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		for _, recipient := range recipients {
+			record.Recipients[recipient] = &RecipientStatus{State: state, Reason: reason, UpdatedAt: now}
+		}
+		return putJSON(b, id, &record)
+	})
+	if err != nil {
+		return err
+	}
+	notifyDeliveryStatus(db, &record, recipients)
+	return nil
+}
+
+// GetDeliveryRecordBolt retrieves the delivery status of a tracked message
+func GetDeliveryRecordBolt(db *bbolt.DB, id string) (*DeliveryRecord, error) {
+	var record DeliveryRecord
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(deliveryBucket).Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("delivery record not found: %s", id)
+		}
+		return json.Unmarshal(data, &record)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
@@ -0,0 +1,57 @@
+// hooks.go
+// Notifications for writes to the EMSG Daemon BoltDB store
+package storage
+
+import (
+	"sync"
+
+	"emsg-daemon/internal/message"
+
+	"go.etcd.io/bbolt"
+)
+
+// MessageHook is called after a message has been committed to the mailboxes of recipients
+type MessageHook func(msg *message.Message, recipients []string)
+
+// DeliveryHook is called after the delivery state of some recipients of record has changed
+type DeliveryHook func(record *DeliveryRecord, recipients []string)
+
+var (
+	hooksMu       sync.RWMutex
+	messageHooks  = make(map[*bbolt.DB][]MessageHook)
+	deliveryHooks = make(map[*bbolt.DB][]DeliveryHook)
+)
+
+// OnMessageStored registers fn to run after every message stored in db
+func OnMessageStored(db *bbolt.DB, fn MessageHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	messageHooks[db] = append(messageHooks[db], fn)
+}
+
+// notifyMessageStored runs the hooks registered for db
+func notifyMessageStored(db *bbolt.DB, msg *message.Message, recipients []string) {
+	hooksMu.RLock()
+	hooks := messageHooks[db]
+	hooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(msg, recipients)
+	}
+}
+
+// OnDeliveryStatus registers fn to run after every delivery status update in db
+func OnDeliveryStatus(db *bbolt.DB, fn DeliveryHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	deliveryHooks[db] = append(deliveryHooks[db], fn)
+}
+
+// notifyDeliveryStatus runs the delivery hooks registered for db
+func notifyDeliveryStatus(db *bbolt.DB, record *DeliveryRecord, recipients []string) {
+	hooksMu.RLock()
+	hooks := deliveryHooks[db]
+	hooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(record, recipients)
+	}
+}
@@ -0,0 +1,203 @@
+// invites.go
+// Group invitations with signed, expiring tokens for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"emsg-daemon/internal/group"
+
+	"go.etcd.io/bbolt"
+)
+
+// Invite errors
+var (
+	ErrInviteInvalid   = errors.New("invalid invite token")
+	ErrInviteNotFound  = errors.New("invite not found")
+	ErrInviteExpired   = errors.New("invite has expired")
+	ErrInviteRevoked   = errors.New("invite has been revoked")
+	ErrInviteExhausted = errors.New("invite has no uses left")
+)
+
+// inviteSecretKey names the HMAC key for invite tokens in the meta bucket
+const inviteSecretKey = "invite_secret"
+
+// Invite lets whoever holds its token join a group
+type Invite struct {
+	ID        string `json:"id"`
+	GroupID   string `json:"group_id"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"` // Unix timestamp
+	ExpiresAt int64  `json:"expires_at"` // Unix timestamp
+	MaxUses   int    `json:"max_uses"`   // 0 means unlimited
+	Uses      int    `json:"uses"`
+	Revoked   bool   `json:"revoked"`
+	Token     string `json:"token,omitempty"` // not stored; filled in for the API
+}
+
+// usable reports why an invite cannot be redeemed at now, or nil
+func (inv *Invite) usable(now time.Time) error {
+	switch {
+	case inv.Revoked:
+		return ErrInviteRevoked
+	case now.Unix() >= inv.ExpiresAt:
+		return ErrInviteExpired
+	case inv.MaxUses > 0 && inv.Uses >= inv.MaxUses:
+		return ErrInviteExhausted
+	}
+	return nil
+}
+
+// CreateInviteBolt stores a new invite, assigning its ID and creation time, and fills in its token
+func CreateInviteBolt(db *bbolt.DB, inv *Invite) error {
+	id, err := newDeliveryID()
+	if err != nil {
+		return err
+	}
+	inv.ID = id
+	inv.CreatedAt = time.Now().Unix()
+	inv.Token = ""
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(groupsBucket).Get([]byte(inv.GroupID)) == nil {
+			return fmt.Errorf("%w: %s", ErrGroupNotFound, inv.GroupID)
+		}
+		if err := putJSON(tx.Bucket(invitesBucket), inv.ID, inv); err != nil {
+			return err
+		}
+		secret, err := serverSecretTx(tx, inviteSecretKey)
+		if err != nil {
+			return err
+		}
+		inv.Token = signInvite(secret, inv.ID)
+		return nil
+	})
+}
+
+// ListInvitesBolt returns the invites of a group, including revoked and used-up ones, with their tokens
+func ListInvitesBolt(db *bbolt.DB, groupID string) ([]Invite, error) {
+	var invites []Invite
+	err := db.Update(func(tx *bbolt.Tx) error {
+		secret, err := serverSecretTx(tx, inviteSecretKey)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(invitesBucket).ForEach(func(k, v []byte) error {
+			var inv Invite
+			if err := json.Unmarshal(v, &inv); err != nil {
+				return err
+			}
+			if inv.GroupID == groupID {
+				inv.Token = signInvite(secret, inv.ID)
+				invites = append(invites, inv)
+			}
+			return nil
+		})
+	})
+	return invites, err
+}
+
+// RevokeInviteBolt stops an invite of a group from being redeemed
+func RevokeInviteBolt(db *bbolt.DB, groupID, id string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(invitesBucket)
+		inv, err := getInviteTx(b, id)
+		if err != nil || inv.GroupID != groupID {
+			return ErrInviteNotFound
+		}
+		inv.Revoked = true
+		return putJSON(b, id, inv)
+	})
+}
+
+// RedeemInviteBolt adds address to the group of the invite named by token and
+// counts the use, in one transaction. The group's events are delivered to sink
+// after the change has been committed.
+func RedeemInviteBolt(db *bbolt.DB, token, address string, sink group.EventSink) (*group.Group, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInviteInvalid
+	}
+
+	var grp *group.Group
+	buffer := &group.EventBuffer{}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		secret, err := serverSecretTx(tx, inviteSecretKey)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(signInvite(secret, id)), []byte(token)) {
+			return ErrInviteInvalid
+		}
+
+		b := tx.Bucket(invitesBucket)
+		inv, err := getInviteTx(b, id)
+		if err != nil {
+			return ErrInviteInvalid
+		}
+		if err := inv.usable(time.Now()); err != nil {
+			return err
+		}
+
+		grp, err = updateGroupTx(tx, inv.GroupID, buffer, func(g *group.Group) error {
+			return g.AddMember(address)
+		})
+		if err != nil {
+			return err
+		}
+		inv.Uses++
+		return putJSON(b, id, inv)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	grp.Sink = sink
+	if sink != nil {
+		buffer.Flush(sink)
+	}
+	return grp, nil
+}
+
+// getInviteTx reads an invite by ID
+func getInviteTx(b *bbolt.Bucket, id string) (*Invite, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, ErrInviteNotFound
+	}
+	var inv Invite
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// signInvite builds the token for an invite ID: the ID and its HMAC-SHA256
+func signInvite(secret []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// serverSecretTx returns the named random secret from the meta bucket, creating it on first use
+func serverSecretTx(tx *bbolt.Tx, name string) ([]byte, error) {
+	b := tx.Bucket(metaBucket)
+	if secret := b.Get([]byte(name)); secret != nil {
+		return append([]byte{}, secret...), nil
+	}
+	secret, err := newDeliveryID()
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Put([]byte(name), []byte(secret)); err != nil {
+		return nil, err
+	}
+	return []byte(secret), nil
+}
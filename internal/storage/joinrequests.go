@@ -0,0 +1,130 @@
+// joinrequests.go
+// Pending requests to join private groups for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"emsg-daemon/internal/group"
+
+	"go.etcd.io/bbolt"
+)
+
+// Join request errors
+var (
+	ErrJoinRequestExists   = errors.New("join request already pending")
+	ErrJoinRequestNotFound = errors.New("join request not found")
+)
+
+// JoinRequest is a user's pending request to join a private group
+type JoinRequest struct {
+	GroupID   string `json:"group_id"`
+	Address   string `json:"address"`
+	Note      string `json:"note,omitempty"` // optional message to the admins
+	CreatedAt int64  `json:"created_at"`     // Unix timestamp
+}
+
+// CreateJoinRequestBolt stores a pending join request and notifies the group's
+// admins through sink once it has been saved
+func CreateJoinRequestBolt(db *bbolt.DB, req *JoinRequest, sink group.EventSink) error {
+	req.CreatedAt = time.Now().Unix()
+
+	buffer := &group.EventBuffer{}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := updateGroupTx(tx, req.GroupID, buffer, func(grp *group.Group) error {
+			if grp.Archived {
+				return group.ErrArchived
+			}
+			if grp.IsMember(req.Address) {
+				return group.ErrAlreadyMember
+			}
+			box, err := tx.Bucket(joinRequestsBucket).CreateBucketIfNotExists([]byte(req.GroupID))
+			if err != nil {
+				return err
+			}
+			if box.Get([]byte(req.Address)) != nil {
+				return ErrJoinRequestExists
+			}
+			if err := putJSON(box, req.Address, req); err != nil {
+				return err
+			}
+			grp.NotifyJoinRequested(req.Address)
+			return nil
+		})
+		return err
+	})
+	if err == nil && sink != nil {
+		buffer.Flush(sink)
+	}
+	return err
+}
+
+// ListJoinRequestsBolt returns the pending join requests of a group, oldest first
+func ListJoinRequestsBolt(db *bbolt.DB, groupID string) ([]JoinRequest, error) {
+	var requests []JoinRequest
+	err := db.View(func(tx *bbolt.Tx) error {
+		box := tx.Bucket(joinRequestsBucket).Bucket([]byte(groupID))
+		if box == nil {
+			return nil
+		}
+		return box.ForEach(func(k, v []byte) error {
+			var req JoinRequest
+			if err := json.Unmarshal(v, &req); err != nil {
+				return err
+			}
+			requests = append(requests, req)
+			return nil
+		})
+	})
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].CreatedAt < requests[j].CreatedAt })
+	return requests, err
+}
+
+// ResolveJoinRequestBolt removes the pending join request of address and applies
+// fn to the group in the same transaction: fn approves by adding the member,
+// rejects, or checks the caller's rights. Events are delivered to sink after commit.
+func ResolveJoinRequestBolt(db *bbolt.DB, groupID, address string, sink group.EventSink, fn func(grp *group.Group) error) (*group.Group, error) {
+	var grp *group.Group
+	buffer := &group.EventBuffer{}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		box := tx.Bucket(joinRequestsBucket).Bucket([]byte(groupID))
+		if box == nil || box.Get([]byte(address)) == nil {
+			if tx.Bucket(groupsBucket).Get([]byte(groupID)) == nil {
+				return ErrGroupNotFound
+			}
+			return ErrJoinRequestNotFound
+		}
+		if err := box.Delete([]byte(address)); err != nil {
+			return err
+		}
+		var err error
+		grp, err = updateGroupTx(tx, groupID, buffer, fn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	grp.Sink = sink
+	if sink != nil {
+		buffer.Flush(sink)
+	}
+	return grp, nil
+}
+
+// dropJoinRequestsTx discards the pending requests of users who are now members of grp
+func dropJoinRequestsTx(tx *bbolt.Tx, grp *group.Group) error {
+	box := tx.Bucket(joinRequestsBucket).Bucket([]byte(grp.ID))
+	if box == nil {
+		return nil
+	}
+	for _, member := range grp.Members {
+		if err := box.Delete([]byte(member)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
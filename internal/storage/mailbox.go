@@ -0,0 +1,317 @@
+// mailbox.go
+// Per-user mailbox indexes and paginated queries for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"emsg-daemon/internal/message"
+
+	"go.etcd.io/bbolt"
+)
+
+// Mailbox directions
+const (
+	DirectionReceived = "received"
+	DirectionSent     = "sent"
+)
+
+// MessageQuery selects a page of a user's mailbox. Results are newest first.
+type MessageQuery struct {
+	Limit     int    // maximum number of messages to return
+	Before    string // only messages with IDs below this cursor
+	After     string // only messages with IDs above this cursor
+	Since     int64  // only messages sent at or after this Unix timestamp
+	From      string // only messages from this sender
+	GroupID   string // only messages in this group
+	Direction string // DirectionReceived, DirectionSent, or "" for both
+}
+
+// InboxEntry is a message in a user's inbox with the sequence number it was
+// given on arrival. Sequence numbers only grow, whatever the message's ID.
+type InboxEntry struct {
+	Seq     uint64
+	Message message.Message
+}
+
+// indexMessageTx adds a message ID to the mailbox bucket of each recipient,
+// numbering it with the next sequence number of that mailbox
+func indexMessageTx(tx *bbolt.Tx, id string, recipients []string) error {
+	for _, recipient := range recipients {
+		if recipient == "" {
+			continue
+		}
+		box, err := tx.Bucket(inboxBucket).CreateBucketIfNotExists([]byte(recipient))
+		if err != nil {
+			return err
+		}
+		if box.Get([]byte(id)) != nil {
+			continue
+		}
+		if err := sequenceInboxEntryTx(tx, box, recipient, []byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequenceInboxEntryTx gives an inbox entry the next sequence number of its mailbox
+func sequenceInboxEntryTx(tx *bbolt.Tx, box *bbolt.Bucket, recipient string, id []byte) error {
+	seq, err := box.NextSequence()
+	if err != nil {
+		return err
+	}
+	seqs, err := tx.Bucket(inboxSeqBucket).CreateBucketIfNotExists([]byte(recipient))
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	if err := seqs.Put(key, id); err != nil {
+		return err
+	}
+	return box.Put(id, key)
+}
+
+// unindexMessageTx removes a message ID and its sequence number from a recipient's mailbox
+func unindexMessageTx(tx *bbolt.Tx, id, recipient string) error {
+	box := tx.Bucket(inboxBucket).Bucket([]byte(recipient))
+	if box == nil {
+		return nil
+	}
+	if seq := box.Get([]byte(id)); len(seq) == 8 {
+		if seqs := tx.Bucket(inboxSeqBucket).Bucket([]byte(recipient)); seqs != nil {
+			if err := seqs.Delete(seq); err != nil {
+				return err
+			}
+		}
+	}
+	return box.Delete([]byte(id))
+}
+
+// sequenceInboxesTx numbers the entries of every inbox, in ID order
+func sequenceInboxesTx(tx *bbolt.Tx) error {
+	inbox := tx.Bucket(inboxBucket)
+	var recipients [][]byte
+	if err := inbox.ForEach(func(k, _ []byte) error {
+		recipients = append(recipients, k)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		box := inbox.Bucket(recipient)
+		if box == nil {
+			continue
+		}
+		var ids [][]byte
+		if err := box.ForEach(func(k, _ []byte) error {
+			ids = append(ids, k)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := sequenceInboxEntryTx(tx, box, string(recipient), id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexSentTx adds a message ID to its sender's sent mail
+func indexSentTx(tx *bbolt.Tx, msg *message.Message) error {
+	return addToIndexTx(tx.Bucket(sentBucket), msg.ID, []string{msg.From})
+}
+
+// addToIndexTx adds id to the nested bucket of each address under index
+func addToIndexTx(index *bbolt.Bucket, id string, addresses []string) error {
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+		box, err := index.CreateBucketIfNotExists([]byte(address))
+		if err != nil {
+			return err
+		}
+		if err := box.Put([]byte(id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildMailboxesTx indexes every stored message under its To and CC addresses and its sender
+func rebuildMailboxesTx(tx *bbolt.Tx) error {
+	return tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+		var msg message.Message
+		if err := json.Unmarshal(v, &msg); err != nil {
+			return nil // skip records that predate the current message format
+		}
+		if err := addToIndexTx(tx.Bucket(sentBucket), string(k), []string{msg.From}); err != nil {
+			return err
+		}
+		return indexMessageTx(tx, string(k), msg.Recipients())
+	})
+}
+
+// QueryMessagesBolt returns a page of a user's messages, newest first, and the
+// cursor to pass as Before for the next page ("" when there are no more)
+func QueryMessagesBolt(db *bbolt.DB, user string, q MessageQuery) ([]message.Message, string, error) {
+	var page []message.Message
+	next := ""
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		var sources []*indexCursor
+		if q.Direction != DirectionSent {
+			sources = append(sources, newIndexCursor(tx.Bucket(inboxBucket).Bucket([]byte(user)), q.Before))
+		}
+		if q.Direction != DirectionReceived {
+			sources = append(sources, newIndexCursor(tx.Bucket(sentBucket).Bucket([]byte(user)), q.Before))
+		}
+		var err error
+		page, next, err = queryIndexTx(tx, sources, q, nil)
+		return err
+	})
+
+	return page, next, err
+}
+
+// queryIndexTx pages through the messages named by sources, newest first, that
+// match q and, if keep is not nil, that keep accepts
+func queryIndexTx(tx *bbolt.Tx, sources []*indexCursor, q MessageQuery, keep func(*message.Message) bool) ([]message.Message, string, error) {
+	var page []message.Message
+	msgs := tx.Bucket(messagesBucket)
+	for {
+		id := nextNewest(sources)
+		if id == nil || (q.After != "" && string(id) <= q.After) {
+			return page, "", nil
+		}
+		data := msgs.Get(id)
+		if data == nil {
+			continue
+		}
+		var msg message.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, "", err
+		}
+		if !q.matches(&msg) || (keep != nil && !keep(&msg)) {
+			continue
+		}
+		if q.Limit > 0 && len(page) == q.Limit {
+			return page, page[len(page)-1].ID, nil
+		}
+		page = append(page, msg)
+	}
+}
+
+// matches applies the non-cursor filters of a query
+func (q *MessageQuery) matches(msg *message.Message) bool {
+	if q.Since != 0 && msg.SentAt < q.Since {
+		return false
+	}
+	if q.From != "" && msg.From != q.From {
+		return false
+	}
+	if q.GroupID != "" && msg.GroupID != q.GroupID {
+		return false
+	}
+	return true
+}
+
+// indexCursor walks one mailbox index from newest to oldest
+type indexCursor struct {
+	c   *bbolt.Cursor
+	key []byte
+}
+
+// newIndexCursor positions a cursor on the newest key below before (or the newest key)
+func newIndexCursor(b *bbolt.Bucket, before string) *indexCursor {
+	if b == nil {
+		return &indexCursor{}
+	}
+	c := b.Cursor()
+	var k []byte
+	if before == "" {
+		k, _ = c.Last()
+	} else if k, _ = c.Seek([]byte(before)); k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	return &indexCursor{c: c, key: k}
+}
+
+// nextNewest pops the newest key across sources, merging keys present in several
+func nextNewest(sources []*indexCursor) []byte {
+	var newest []byte
+	for _, s := range sources {
+		if s.key != nil && (newest == nil || bytes.Compare(s.key, newest) > 0) {
+			newest = s.key
+		}
+	}
+	if newest == nil {
+		return nil
+	}
+	newest = append([]byte{}, newest...)
+	for _, s := range sources {
+		if s.key != nil && bytes.Equal(s.key, newest) {
+			s.key, _ = s.c.Prev()
+		}
+	}
+	return newest
+}
+
+// InboxAfterBolt returns up to limit entries from a user's inbox with sequence
+// numbers above after, in arrival order. It is used to replay what a push client missed.
+func InboxAfterBolt(db *bbolt.DB, user string, after uint64, limit int) ([]InboxEntry, error) {
+	var entries []InboxEntry
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		seqs := tx.Bucket(inboxSeqBucket).Bucket([]byte(user))
+		if seqs == nil {
+			return nil
+		}
+		msgs := tx.Bucket(messagesBucket)
+
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, after+1)
+		c := seqs.Cursor()
+		for k, id := c.Seek(start); k != nil && (limit <= 0 || len(entries) < limit); k, id = c.Next() {
+			data := msgs.Get(id)
+			if data == nil {
+				continue
+			}
+			entry := InboxEntry{Seq: binary.BigEndian.Uint64(k)}
+			if err := json.Unmarshal(data, &entry.Message); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+// InboxSequencesBolt returns the sequence number a message was given in the
+// inbox of each recipient. Recipients without the message are left out.
+func InboxSequencesBolt(db *bbolt.DB, id string, recipients []string) (map[string]uint64, error) {
+	seqs := make(map[string]uint64)
+	err := db.View(func(tx *bbolt.Tx) error {
+		for _, recipient := range recipients {
+			box := tx.Bucket(inboxBucket).Bucket([]byte(recipient))
+			if box == nil {
+				continue
+			}
+			if seq := box.Get([]byte(id)); len(seq) == 8 {
+				seqs[recipient] = binary.BigEndian.Uint64(seq)
+			}
+		}
+		return nil
+	})
+	return seqs, err
+}
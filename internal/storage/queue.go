@@ -0,0 +1,220 @@
+// queue.go
+// Persistent outbound delivery queue for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"emsg-daemon/internal/message"
+
+	"go.etcd.io/bbolt"
+)
+
+// Federation errors
+var (
+	ErrOutboundNotFound = errors.New("delivery not queued")
+	ErrMessageConflict  = errors.New("a different message with this id already exists")
+)
+
+// OutboundItem is a pending delivery of one message to the recipients of one remote domain
+type OutboundItem struct {
+	ID          string          `json:"id"`          // delivery ID, sent to the peer so it can drop duplicates
+	TrackingID  string          `json:"tracking_id"` // message ID of the delivery record to update, if tracked
+	Domain      string          `json:"domain"`
+	Recipients  []string        `json:"recipients"`
+	Message     message.Message `json:"message"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   int64           `json:"created_at"`   // Unix timestamp
+	NextAttempt int64           `json:"next_attempt"` // Unix timestamp
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// EnqueueOutboundBolt adds a delivery to the outbound queue, due immediately
+func EnqueueOutboundBolt(db *bbolt.DB, item *OutboundItem) error {
+	if item.ID == "" {
+		id, err := newDeliveryID()
+		if err != nil {
+			return err
+		}
+		item.ID = id
+	}
+	if item.CreatedAt == 0 {
+		item.CreatedAt = time.Now().Unix()
+	}
+	if item.NextAttempt == 0 {
+		item.NextAttempt = item.CreatedAt
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(outboundBucket), item.ID, item)
+	})
+}
+
+// DueOutboundBolt returns the queued deliveries whose next attempt is at or before now
+func DueOutboundBolt(db *bbolt.DB, now time.Time) ([]OutboundItem, error) {
+	var items []OutboundItem
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(outboundBucket).ForEach(func(k, v []byte) error {
+			var item OutboundItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if item.NextAttempt <= now.Unix() {
+				items = append(items, item)
+			}
+			return nil
+		})
+	})
+	return items, err
+}
+
+// GetOutboundBolt returns a queued delivery by its delivery ID
+func GetOutboundBolt(db *bbolt.DB, id string) (*OutboundItem, error) {
+	var item *OutboundItem
+	err := db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(outboundBucket).Get([]byte(id))
+		if data == nil {
+			return ErrOutboundNotFound
+		}
+		item = &OutboundItem{}
+		return json.Unmarshal(data, item)
+	})
+	return item, err
+}
+
+// UpdateOutboundBolt saves the retry state of a queued delivery
+func UpdateOutboundBolt(db *bbolt.DB, item *OutboundItem) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(outboundBucket), item.ID, item)
+	})
+}
+
+// RemoveOutboundBolt drops a delivery from the queue once it has been accepted
+func RemoveOutboundBolt(db *bbolt.DB, id string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(outboundBucket).Delete([]byte(id))
+	})
+}
+
+// DeadLetterOutboundBolt moves a delivery that will not be retried to the dead-letter bucket
+func DeadLetterOutboundBolt(db *bbolt.DB, item *OutboundItem) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(outboundBucket).Delete([]byte(item.ID)); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(deadBucket), item.ID, item)
+	})
+}
+
+// GetDeadLettersBolt lists deliveries that were given up on
+func GetDeadLettersBolt(db *bbolt.DB) ([]OutboundItem, error) {
+	var items []OutboundItem
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(deadBucket).ForEach(func(k, v []byte) error {
+			var item OutboundItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	return items, err
+}
+
+// StoreFederatedMessageBolt stores a message received from a peer server in the
+// mailboxes of recipients. A delivery ID seen before is acknowledged without storing
+// again, so a peer retrying after a crash does not duplicate the message. It reports
+// whether the delivery was a duplicate. A message whose ID is already stored is
+// only indexed for the new recipients if it is the same signed message, and
+// fails with ErrMessageConflict otherwise.
+func StoreFederatedMessageBolt(db *bbolt.DB, deliveryID string, msg *message.Message, recipients []string) (bool, error) {
+	msg.AssignID(time.Now())
+	duplicate := false
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if deliveryID != "" {
+			b := tx.Bucket(receivedBucket)
+			if b.Get([]byte(deliveryID)) != nil {
+				duplicate = true
+				return nil
+			}
+			seenAt := make([]byte, 8)
+			binary.BigEndian.PutUint64(seenAt, uint64(time.Now().Unix()))
+			if err := b.Put([]byte(deliveryID), seenAt); err != nil {
+				return err
+			}
+		}
+		// The same message may arrive once per local domain it was addressed to
+		if err := putMessageTx(tx, msg); err == ErrMessageExists {
+			if err := sameStoredMessageTx(tx, msg); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		if err := indexGroupTx(tx, msg, time.Now().Unix()); err != nil {
+			return err
+		}
+		return indexMessageTx(tx, msg.ID, recipients)
+	})
+	if err == nil && !duplicate {
+		notifyMessageStored(db, msg, recipients)
+	}
+	return duplicate, err
+}
+
+// sameStoredMessageTx checks that the message stored under msg's ID has the same
+// signed content and signature
+func sameStoredMessageTx(tx *bbolt.Tx, msg *message.Message) error {
+	var stored message.Message
+	if err := json.Unmarshal(tx.Bucket(messagesBucket).Get([]byte(msg.ID)), &stored); err != nil {
+		return err
+	}
+	if stored.Signature != msg.Signature || !bytes.Equal(stored.CanonicalBytes(), msg.CanonicalBytes()) {
+		return ErrMessageConflict
+	}
+	return nil
+}
+
+// PruneReceivedDeliveriesBolt forgets delivery IDs received before the cutoff
+func PruneReceivedDeliveriesBolt(db *bbolt.DB, before time.Time) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(receivedBucket)
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 && int64(binary.BigEndian.Uint64(v)) < before.Unix() {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putJSON marshals v and stores it under key
+func putJSON(b *bbolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// newDeliveryID generates a random delivery identifier
+func newDeliveryID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,39 @@
+// remotegroups.go
+// Local members of groups hosted on other servers, for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"go.etcd.io/bbolt"
+)
+
+// AddRemoteGroupMembersBolt records local addresses as members of a group hosted
+// on another server, as learned from the group's confirmed deliveries
+func AddRemoteGroupMembersBolt(db *bbolt.DB, groupID string, members []string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		for _, member := range members {
+			if err := addToIndexTx(tx.Bucket(remoteMembersBucket), member, []string{groupID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// KnownRemoteGroupMembersBolt returns the addresses, in order, that are recorded
+// members of a group hosted on another server
+func KnownRemoteGroupMembersBolt(db *bbolt.DB, groupID string, addresses []string) ([]string, error) {
+	var known []string
+	err := db.View(func(tx *bbolt.Tx) error {
+		members := tx.Bucket(remoteMembersBucket).Bucket([]byte(groupID))
+		if members == nil {
+			return nil
+		}
+		for _, address := range addresses {
+			if members.Get([]byte(address)) != nil {
+				known = append(known, address)
+			}
+		}
+		return nil
+	})
+	return known, err
+}
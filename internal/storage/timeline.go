@@ -0,0 +1,105 @@
+// timeline.go
+// Per-group message timelines for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"emsg-daemon/internal/message"
+
+	"go.etcd.io/bbolt"
+)
+
+// indexGroupTx adds a message to the timelines of its group and of any groups it
+// CCs, for those hosted here, recording the Unix time it was added. A message
+// already in a timeline keeps its original time.
+func indexGroupTx(tx *bbolt.Tx, msg *message.Message, addedAt int64) error {
+	for _, groupID := range timelineGroups(msg) {
+		if tx.Bucket(groupsBucket).Get([]byte(groupID)) == nil {
+			continue
+		}
+		timeline, err := tx.Bucket(groupTimelineBucket).CreateBucketIfNotExists([]byte(groupID))
+		if err != nil {
+			return err
+		}
+		if timeline.Get([]byte(msg.ID)) != nil {
+			continue
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(addedAt))
+		if err := timeline.Put([]byte(msg.ID), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexGroupTx removes a message from every timeline indexGroupTx put it in
+func unindexGroupTx(tx *bbolt.Tx, msg *message.Message) error {
+	for _, groupID := range timelineGroups(msg) {
+		if timeline := tx.Bucket(groupTimelineBucket).Bucket([]byte(groupID)); timeline != nil {
+			if err := timeline.Delete([]byte(msg.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// timelineGroups returns the addresses that may name a group the message was posted to
+func timelineGroups(msg *message.Message) []string {
+	var groups []string
+	if msg.GroupID != "" {
+		groups = append(groups, msg.GroupID)
+	}
+	for _, cc := range msg.CC {
+		if cc != msg.GroupID {
+			groups = append(groups, cc)
+		}
+	}
+	return groups
+}
+
+// rebuildGroupTimelinesTx indexes every stored message in the timeline of its group.
+// When the stored messages arrived is not known, so their sent time stands in.
+func rebuildGroupTimelinesTx(tx *bbolt.Tx) error {
+	return tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+		var msg message.Message
+		if err := json.Unmarshal(v, &msg); err != nil {
+			return nil // skip records that predate the current message format
+		}
+		return indexGroupTx(tx, &msg, msg.SentAt)
+	})
+}
+
+// timelineAddedAt returns when a message was added to a timeline. Entries written
+// before the time was recorded fall back to the message's sent time.
+func timelineAddedAt(timeline *bbolt.Bucket, msg *message.Message) int64 {
+	if v := timeline.Get([]byte(msg.ID)); len(v) == 8 {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return msg.SentAt
+}
+
+// QueryGroupTimelineBolt returns a page of a group's messages, newest first, and
+// the cursor to pass as Before for the next page ("" when there are no more).
+// Only messages added to the timeline at or after addedSince (a Unix time, 0 for
+// all) are returned. The query's Direction and GroupID are ignored.
+func QueryGroupTimelineBolt(db *bbolt.DB, groupID string, q MessageQuery, addedSince int64) ([]message.Message, string, error) {
+	var page []message.Message
+	next := ""
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		timeline := tx.Bucket(groupTimelineBucket).Bucket([]byte(groupID))
+		source := newIndexCursor(timeline, q.Before)
+		q.GroupID = ""
+		var err error
+		page, next, err = queryIndexTx(tx, []*indexCursor{source}, q, func(msg *message.Message) bool {
+			return addedSince == 0 || timelineAddedAt(timeline, msg) >= addedSince
+		})
+		return err
+	})
+
+	return page, next, err
+}
@@ -0,0 +1,171 @@
+// webhooks.go
+// Webhook registrations and their delivery queue for EMSG Daemon (BoltDB)
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Webhook is a URL that receives signed event notifications for its owner
+type Webhook struct {
+	ID        string   `json:"id"`
+	Owner     string   `json:"owner"` // address whose events are delivered
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"` // HMAC key for the signature header
+	Events    []string `json:"events"`           // event types to deliver
+	CreatedAt int64    `json:"created_at"`       // Unix timestamp
+}
+
+// Wants reports whether the webhook is subscribed to eventType
+func (w *Webhook) Wants(eventType string) bool {
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a pending POST of one event to one webhook
+type WebhookDelivery struct {
+	ID          string          `json:"id"`
+	Owner       string          `json:"owner"`
+	WebhookID   string          `json:"webhook_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   int64           `json:"created_at"`   // Unix timestamp
+	NextAttempt int64           `json:"next_attempt"` // Unix timestamp
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// CreateWebhookBolt registers a webhook, assigning its ID, secret and creation time
+func CreateWebhookBolt(db *bbolt.DB, hook *Webhook) error {
+	id, err := newDeliveryID()
+	if err != nil {
+		return err
+	}
+	secret, err := newDeliveryID()
+	if err != nil {
+		return err
+	}
+	hook.ID = id
+	hook.Secret = secret
+	hook.CreatedAt = time.Now().Unix()
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		box, err := tx.Bucket(webhooksBucket).CreateBucketIfNotExists([]byte(hook.Owner))
+		if err != nil {
+			return err
+		}
+		return putJSON(box, hook.ID, hook)
+	})
+}
+
+// GetWebhooksBolt lists the webhooks registered by owner
+func GetWebhooksBolt(db *bbolt.DB, owner string) ([]Webhook, error) {
+	var hooks []Webhook
+	err := db.View(func(tx *bbolt.Tx) error {
+		box := tx.Bucket(webhooksBucket).Bucket([]byte(owner))
+		if box == nil {
+			return nil
+		}
+		return box.ForEach(func(k, v []byte) error {
+			var hook Webhook
+			if err := json.Unmarshal(v, &hook); err != nil {
+				return err
+			}
+			hooks = append(hooks, hook)
+			return nil
+		})
+	})
+	return hooks, err
+}
+
+// GetWebhookBolt retrieves one of owner's webhooks
+func GetWebhookBolt(db *bbolt.DB, owner, id string) (*Webhook, error) {
+	var hook Webhook
+	err := db.View(func(tx *bbolt.Tx) error {
+		box := tx.Bucket(webhooksBucket).Bucket([]byte(owner))
+		if box == nil {
+			return fmt.Errorf("webhook not found: %s", id)
+		}
+		data := box.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("webhook not found: %s", id)
+		}
+		return json.Unmarshal(data, &hook)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// DeleteWebhookBolt removes one of owner's webhooks. Pending deliveries to it are
+// dropped by the worker when it finds the webhook gone.
+func DeleteWebhookBolt(db *bbolt.DB, owner, id string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		box := tx.Bucket(webhooksBucket).Bucket([]byte(owner))
+		if box == nil || box.Get([]byte(id)) == nil {
+			return fmt.Errorf("webhook not found: %s", id)
+		}
+		return box.Delete([]byte(id))
+	})
+}
+
+// EnqueueWebhookDeliveryBolt queues an event for a webhook, due immediately
+func EnqueueWebhookDeliveryBolt(db *bbolt.DB, delivery *WebhookDelivery) error {
+	if delivery.ID == "" {
+		id, err := newDeliveryID()
+		if err != nil {
+			return err
+		}
+		delivery.ID = id
+	}
+	if delivery.CreatedAt == 0 {
+		delivery.CreatedAt = time.Now().Unix()
+	}
+	if delivery.NextAttempt == 0 {
+		delivery.NextAttempt = delivery.CreatedAt
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(webhookQueueBucket), delivery.ID, delivery)
+	})
+}
+
+// DueWebhookDeliveriesBolt returns the queued webhook deliveries due at or before now
+func DueWebhookDeliveriesBolt(db *bbolt.DB, now time.Time) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).ForEach(func(k, v []byte) error {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			if delivery.NextAttempt <= now.Unix() {
+				deliveries = append(deliveries, delivery)
+			}
+			return nil
+		})
+	})
+	return deliveries, err
+}
+
+// UpdateWebhookDeliveryBolt saves the retry state of a queued webhook delivery
+func UpdateWebhookDeliveryBolt(db *bbolt.DB, delivery *WebhookDelivery) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(webhookQueueBucket), delivery.ID, delivery)
+	})
+}
+
+// RemoveWebhookDeliveryBolt drops a webhook delivery from the queue
+func RemoveWebhookDeliveryBolt(db *bbolt.DB, id string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).Delete([]byte(id))
+	})
+}
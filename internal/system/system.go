@@ -3,30 +3,120 @@
 package system
 
 import (
-	"database/sql"
 	"fmt"
-)
+	"log"
+	"strings"
+
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/router"
+	"emsg-daemon/internal/storage"
 
-// Expanded system message types
-const (
-	SystemGroupCreated       = "group_created"
-	SystemUserJoined         = "user_joined"
-	SystemUserLeft           = "user_left"
-	SystemUserRemoved        = "user_removed"
-	SystemAdminAssigned      = "admin_assigned"
-	SystemAdminRevoked       = "admin_revoked"
-	SystemGroupRenamed       = "group_renamed"
-	SystemDescriptionUpdated = "description_updated"
-	SystemDPUpdated          = "dp_updated"
+	"go.etcd.io/bbolt"
 )
 
-// SendSystemMessage creates, stores, and logs a system message for group events
-func SendSystemMessage(event, groupID, user string, db *sql.DB) {
-	msg := fmt.Sprintf("[SYSTEM] %s: user %s in group %s", event, user, groupID)
-	fmt.Println(msg)
-	if db != nil {
-		db.Exec(`INSERT INTO messages (from_addr, to_addr, cc_addr, group_id, body, signature) VALUES (?, ?, ?, ?, ?, ?)`,
-			"system#local", groupID, "", groupID, msg, "")
+// Address is the sender of system-authored messages
+const Address = "system#local"
+
+// user is the user part of every system address
+const user = "system"
+
+// DomainAddress returns the address a domain's group events are relayed to other
+// servers from, e.g. system#a.example. Peers never accept Address itself.
+func DomainAddress(domain string) string {
+	return user + "#" + domain
+}
+
+// IsAddress reports whether address is Address or a domain's system address
+func IsAddress(address string) bool {
+	return address == Address || strings.HasPrefix(address, user+"#")
+}
+
+// NewBounceMessage builds the notice sent to a message's author when delivery to
+// some of its recipients has permanently failed
+func NewBounceMessage(original *message.Message, recipients []string, reason string) *message.Message {
+	body := fmt.Sprintf("[SYSTEM] Delivery failed for %s: %s\n\nOriginal message:\n%s",
+		strings.Join(recipients, ", "), reason, original.Body)
+	return &message.Message{
+		From: Address,
+		To:   []string{original.From},
+		Body: body,
+	}
+}
+
+// adminEvents are announced to the group's admins rather than all its members
+var adminEvents = map[string]bool{
+	group.SystemJoinRequested: true,
+	group.SystemJoinRejected:  true,
+}
+
+// NewGroupEventMessage builds the system message announcing a group event to every
+// member of g and to the affected user, who may just have left. Join request
+// events go to the admins only, plus the user for a rejection.
+func NewGroupEventMessage(g *group.Group, event, user string) *message.Message {
+	body := fmt.Sprintf("[SYSTEM] %s in group %s", event, g.ID)
+	if user != "" {
+		body = fmt.Sprintf("[SYSTEM] %s: user %s in group %s", event, user, g.ID)
+	}
+	to := append([]string{}, g.Members...)
+	if adminEvents[event] {
+		to = append([]string{}, g.Admins...)
+	}
+	if user != "" && event != group.SystemJoinRequested && !contains(to, user) {
+		to = append(to, user)
+	}
+	return &message.Message{
+		From:    Address,
+		To:      to,
+		GroupID: g.ID,
+		Body:    body,
+	}
+}
+
+// BoltSink is a group.EventSink that stores each group event as a system message
+// in the BoltDB mailboxes of the group's members. When Domains is set, members in
+// other domains get the message through Relay instead, sent from the system
+// address of the group's domain.
+type BoltSink struct {
+	DB      *bbolt.DB
+	Domains []string                                              // domains delivered locally; nil stores for everyone
+	Relay   func(msg *message.Message, recipients []string) error // queues msg for remote members
+}
+
+// GroupEvent stores the system message for event
+func (s *BoltSink) GroupEvent(g *group.Group, event, user string) {
+	msg := NewGroupEventMessage(g, event, user)
+	if len(msg.To) == 0 {
+		return
+	}
+	local, remote := msg.To, []string(nil)
+	if s.Domains != nil {
+		local, remote = router.PartitionRecipients(msg.To, s.Domains)
+	}
+	deliver := storage.DeliverMessageBolt
+	if adminEvents[event] {
+		deliver = storage.DeliverNoticeBolt
+	}
+	if err := deliver(s.DB, msg, local); err != nil {
+		log.Printf("system message %s for group %s: %v", event, g.ID, err)
+		return
+	}
+	// Groups with bare IDs stay on this server
+	domain := router.DomainOf(g.ID)
+	if len(remote) > 0 && s.Relay != nil && domain != "" {
+		relayed := *msg
+		relayed.From = DomainAddress(domain)
+		if err := s.Relay(&relayed, remote); err != nil {
+			log.Printf("relaying system message %s for group %s: %v", event, g.ID, err)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-	// TODO: Broadcast to group members if needed
+	return false
 }
@@ -0,0 +1,51 @@
+// dial.go
+// Outbound connection guard that keeps webhooks off loopback and private networks
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a webhook URL resolves to an address the
+// daemon refuses to connect to
+var ErrForbiddenAddress = errors.New("webhook address is not publicly routable")
+
+// CheckAddress rejects loopback, private (RFC 1918 and fc00::/7), link-local
+// (including the 169.254.169.254 metadata endpoint), multicast and unspecified addresses
+func CheckAddress(ip net.IP) error {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, ip)
+	}
+	return nil
+}
+
+// checkDial is a net.Dialer Control hook. It runs after DNS resolution on the
+// address actually being dialed, so a name that later resolves to a private
+// address (DNS rebinding) is refused too.
+func checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return CheckAddress(ip)
+}
+
+// NewClient creates the HTTP client used for webhook deliveries. It connects
+// directly, without an environment proxy, and only to public addresses.
+func NewClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
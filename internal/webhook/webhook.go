@@ -0,0 +1,228 @@
+// webhook.go
+// Signed outgoing webhooks for new-message and group events
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"emsg-daemon/internal/federation"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+
+	"go.etcd.io/bbolt"
+)
+
+// Event types a webhook can subscribe to
+const (
+	EventMessage = "message" // a message arrived in the owner's mailbox
+	EventGroup   = "group"   // a system event fired in a group the owner administers
+)
+
+// Request headers sent with every webhook POST
+const (
+	SignatureHeader = "X-EMSG-Signature" // "sha256=" + hex HMAC of "<timestamp>.<body>"
+	TimestampHeader = "X-EMSG-Timestamp" // Unix timestamp covered by the signature
+	EventHeader     = "X-EMSG-Event"
+	DeliveryHeader  = "X-EMSG-Delivery" // stable across retries of one delivery
+)
+
+// Default retry schedule for webhook deliveries
+const (
+	DefaultPollInterval = 5 * time.Second
+	DefaultBaseDelay    = 10 * time.Second
+	DefaultMaxDelay     = 30 * time.Minute
+	DefaultMaxAge       = 24 * time.Hour
+)
+
+// Payload is the JSON body POSTed to a webhook
+type Payload struct {
+	Event   string           `json:"event"`
+	Owner   string           `json:"owner"`
+	GroupID string           `json:"group_id,omitempty"`
+	Message *message.Message `json:"message"`
+}
+
+// Sign returns the signature header value for a body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header value in constant time
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Register queues webhook deliveries for every message stored in db
+func Register(db *bbolt.DB) {
+	storage.OnMessageStored(db, func(msg *message.Message, recipients []string) {
+		dispatch(db, msg, recipients)
+	})
+}
+
+// dispatch queues the events caused by a stored message. A system message about
+// a group goes to the group's admins as a group event instead of a message event.
+func dispatch(db *bbolt.DB, msg *message.Message, recipients []string) {
+	notified := make(map[string]bool)
+	if msg.From == system.Address && msg.GroupID != "" {
+		if grp, err := storage.GetGroupBolt(db, msg.GroupID); err == nil {
+			for _, admin := range grp.Admins {
+				enqueue(db, &Payload{Event: EventGroup, Owner: admin, GroupID: msg.GroupID, Message: msg})
+				notified[admin] = true
+			}
+		}
+	}
+	for _, recipient := range recipients {
+		if !notified[recipient] {
+			enqueue(db, &Payload{Event: EventMessage, Owner: recipient, GroupID: msg.GroupID, Message: msg})
+		}
+	}
+}
+
+// enqueue queues payload for each of its owner's webhooks subscribed to the event
+func enqueue(db *bbolt.DB, payload *Payload) {
+	hooks, err := storage.GetWebhooksBolt(db, payload.Owner)
+	if err != nil || len(hooks) == 0 {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("webhooks: %v", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !hook.Wants(payload.Event) {
+			continue
+		}
+		delivery := &storage.WebhookDelivery{Owner: hook.Owner, WebhookID: hook.ID, Event: payload.Event, Payload: data}
+		if err := storage.EnqueueWebhookDeliveryBolt(db, delivery); err != nil {
+			log.Printf("webhooks: %v", err)
+		}
+	}
+}
+
+// Worker POSTs queued webhook deliveries, retrying with exponential backoff until
+// they are accepted, rejected permanently, or older than MaxAge
+type Worker struct {
+	DB           *bbolt.DB
+	Client       *http.Client
+	PollInterval time.Duration
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	MaxAge       time.Duration
+}
+
+// NewWorker creates a Worker with the default retry schedule and a client that
+// refuses private addresses (see NewClient)
+func NewWorker(db *bbolt.DB) *Worker {
+	return &Worker{
+		DB:           db,
+		Client:       NewClient(),
+		PollInterval: DefaultPollInterval,
+		BaseDelay:    DefaultBaseDelay,
+		MaxDelay:     DefaultMaxDelay,
+		MaxAge:       DefaultMaxAge,
+	}
+}
+
+// Run processes the queue every PollInterval until stop is closed
+func (w *Worker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		w.ProcessDue(time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue attempts every webhook delivery that is due at now
+func (w *Worker) ProcessDue(now time.Time) {
+	deliveries, err := storage.DueWebhookDeliveriesBolt(w.DB, now)
+	if err != nil {
+		log.Printf("webhooks: %v", err)
+		return
+	}
+	for i := range deliveries {
+		w.attempt(&deliveries[i], now)
+	}
+}
+
+// attempt sends one delivery and records the outcome
+func (w *Worker) attempt(delivery *storage.WebhookDelivery, now time.Time) {
+	hook, err := storage.GetWebhookBolt(w.DB, delivery.Owner, delivery.WebhookID)
+	if err != nil {
+		w.remove(delivery) // webhook was deleted
+		return
+	}
+
+	status, err := w.send(hook, delivery, now)
+	if err == nil {
+		w.remove(delivery)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	age := now.Sub(time.Unix(delivery.CreatedAt, 0))
+	permanent := status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+	permanent = permanent || errors.Is(err, ErrForbiddenAddress)
+	if permanent || age >= w.MaxAge {
+		log.Printf("webhooks: giving up on %s to %s after %d attempts: %v", delivery.ID, hook.URL, delivery.Attempts, err)
+		w.remove(delivery)
+		return
+	}
+
+	delivery.NextAttempt = now.Add(federation.Backoff(delivery.Attempts, w.BaseDelay, w.MaxDelay)).Unix()
+	if err := storage.UpdateWebhookDeliveryBolt(w.DB, delivery); err != nil {
+		log.Printf("webhooks: %v", err)
+	}
+}
+
+// send POSTs the signed payload and returns the response status
+func (w *Worker) send(hook *storage.Webhook, delivery *storage.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, timestamp, delivery.Payload))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// remove drops a delivery from the queue
+func (w *Worker) remove(delivery *storage.WebhookDelivery) {
+	if err := storage.RemoveWebhookDeliveryBolt(w.DB, delivery.ID); err != nil {
+		log.Printf("webhooks: %v", err)
+	}
+}
@@ -0,0 +1,632 @@
+// federation_test.go
+// Tests for server-to-server message delivery
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"emsg-daemon/api"
+	"emsg-daemon/internal/federation"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/router"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticKeys resolves sender keys from a fixed map
+type staticKeys map[string]ed25519.PublicKey
+
+func (k staticKeys) ResolveKey(address string) (ed25519.PublicKey, error) {
+	if key, ok := k[address]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown sender %s", address)
+}
+
+// newTestBoltAPI opens a fresh BoltDB in a temp dir serving the given local domains
+func newTestBoltAPI(t *testing.T, domains ...string) *api.BoltAPI {
+	t.Helper()
+	db, err := storage.InitBoltDB(filepath.Join(t.TempDir(), "emsg.db"))
+	if err != nil {
+		t.Fatalf("InitBoltDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &api.BoltAPI{DB: db, Domains: domains}
+}
+
+func TestSenderSendPostsEnvelope(t *testing.T) {
+	var received []federation.Envelope
+	status := http.StatusAccepted
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != federation.InboundPath {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var env federation.Envelope
+		if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+			t.Errorf("failed to decode envelope: %v", err)
+		}
+		received = append(received, env)
+		w.WriteHeader(status)
+	}))
+	defer peer.Close()
+
+	msg := message.Message{From: "alice#local.dev", To: []string{"carol#remote.dev"}, Body: "hello"}
+	sender := federation.NewSender([]string{"local.dev"})
+	if err := sender.Send(peer.URL, &federation.Envelope{Message: msg, Recipients: msg.To}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if len(received) != 1 || len(received[0].Recipients) != 1 || received[0].Recipients[0] != "carol#remote.dev" {
+		t.Errorf("expected one envelope for carol, got %+v", received)
+	}
+
+	status = http.StatusBadRequest
+	err := sender.Send(peer.URL, &federation.Envelope{Message: msg, Recipients: msg.To})
+	if !federation.IsPermanent(err) {
+		t.Errorf("expected a permanent failure for a rejecting peer, got %v", err)
+	}
+}
+
+func TestReceiveFederatedMessage(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	receiver := newTestBoltAPI(t, "remote.dev")
+	receiver.Keys = staticKeys{"alice#local.dev": pub}
+
+	msg := message.Message{From: "alice#local.dev", To: []string{"carol#remote.dev"}, Body: "hello"}
+	msg.Sign(priv)
+
+	post := func(env federation.Envelope) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(env)
+		w := httptest.NewRecorder()
+		receiver.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+		return w
+	}
+
+	if w := post(federation.Envelope{Message: msg, Recipients: []string{"carol#remote.dev"}}); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d: %s", w.Code, w.Body.String())
+	}
+	msgs, err := storage.GetMessagesByUserBolt(receiver.DB, "carol#remote.dev")
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected stored message for carol, got %d (%v)", len(msgs), err)
+	}
+
+	if w := post(federation.Envelope{Message: msg, Recipients: []string{"dave#elsewhere.dev"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for non-local recipient, got %d", w.Code)
+	}
+
+	forged := msg
+	forged.Body = "tampered"
+	if w := post(federation.Envelope{Message: forged, Recipients: []string{"carol#remote.dev"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for bad signature, got %d", w.Code)
+	}
+
+	unknown := message.Message{From: "zoe#local.dev", To: []string{"carol#remote.dev"}, Body: "hi"}
+	unknown.Sign(priv)
+	w := post(federation.Envelope{Message: unknown, Recipients: []string{"carol#remote.dev"}})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when the sender key cannot be resolved, got %d", w.Code)
+	}
+	if federation.IsPermanent(&federation.DeliveryError{StatusCode: w.Code}) {
+		t.Error("expected an unresolved sender key to be retried")
+	}
+}
+
+func TestReceiveOnlyDeliversToAddressedRecipients(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	receiver := newTestBoltAPI(t, "remote.dev")
+	receiver.Keys = staticKeys{"alice#local.dev": pub}
+	post := func(env federation.Envelope) int {
+		body, _ := json.Marshal(env)
+		w := httptest.NewRecorder()
+		receiver.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+		return w.Code
+	}
+
+	msg := message.Message{From: "alice#local.dev", To: []string{"carol#remote.dev"}, CC: []string{"erin#remote.dev"}, Body: "hello"}
+	msg.Sign(priv)
+
+	// A peer replaying the signed message to someone it never named is refused
+	if code := post(federation.Envelope{Message: msg, Recipients: []string{"carol#remote.dev", "dave#remote.dev"}, DeliveryID: "d1"}); code != http.StatusForbidden {
+		t.Errorf("expected 403 for an unaddressed recipient, got %d", code)
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(receiver.DB, "dave#remote.dev"); len(msgs) != 0 {
+		t.Fatalf("expected nothing for dave, got %+v", msgs)
+	}
+
+	if code := post(federation.Envelope{Message: msg, Recipients: []string{"carol#remote.dev"}, DeliveryID: "d2"}); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := post(federation.Envelope{Message: msg, Recipients: []string{"erin#remote.dev"}, DeliveryID: "d3"}); code != http.StatusCreated {
+		t.Errorf("expected the same message to reach another named recipient, got %d", code)
+	}
+}
+
+func TestReceiveRejectsReusedMessageID(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	receiver := newTestBoltAPI(t, "remote.dev")
+	receiver.Keys = staticKeys{"alice#local.dev": pub}
+	post := func(env federation.Envelope) int {
+		body, _ := json.Marshal(env)
+		w := httptest.NewRecorder()
+		receiver.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+		return w.Code
+	}
+
+	msg := message.Message{From: "alice#local.dev", To: []string{"carol#remote.dev"}, CC: []string{"erin#remote.dev"}, Body: "hello"}
+	msg.Sign(priv)
+	if code := post(federation.Envelope{Message: msg, Recipients: []string{"carol#remote.dev"}, DeliveryID: "d1"}); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := post(federation.Envelope{Message: msg, Recipients: []string{"erin#remote.dev"}, DeliveryID: "d2"}); code != http.StatusCreated {
+		t.Errorf("expected the same message to reach another recipient, got %d", code)
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(receiver.DB, "erin#remote.dev"); len(msgs) != 1 {
+		t.Errorf("expected erin to have the message, got %d", len(msgs))
+	}
+
+	// A different message reusing the ID does not get indexed under it
+	other := msg
+	other.Body, other.CC = "changed", []string{"frank#remote.dev"}
+	other.Sign(priv)
+	if code := post(federation.Envelope{Message: other, Recipients: []string{"frank#remote.dev"}, DeliveryID: "d3"}); code != http.StatusConflict {
+		t.Errorf("expected 409 for a different message with a taken ID, got %d", code)
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(receiver.DB, "frank#remote.dev"); len(msgs) != 0 {
+		t.Errorf("expected nothing for frank, got %+v", msgs)
+	}
+}
+
+func TestReceiveChecksMessageTimes(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	receiver := newTestBoltAPI(t, "remote.dev")
+	receiver.Keys = staticKeys{"alice#local.dev": pub}
+	post := func(sent time.Time, id string) int {
+		msg := message.Message{ID: id, From: "alice#local.dev", To: []string{"carol#remote.dev"}, Body: "hello", SentAt: sent.Unix()}
+		msg.Sign(priv)
+		body, _ := json.Marshal(federation.Envelope{Message: msg, Recipients: msg.To})
+		w := httptest.NewRecorder()
+		receiver.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+		return w.Code
+	}
+
+	future := time.Now().Add(time.Hour)
+	if code := post(future, message.NewID(future)); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a message from the future, got %d", code)
+	}
+	if code := post(time.Now(), message.NewID(time.Now().Add(-time.Hour))); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an ID that does not encode sent_at, got %d", code)
+	}
+	// Messages may have waited in the sender's queue
+	past := time.Now().Add(-6 * time.Hour)
+	if code := post(past, message.NewID(past)); code != http.StatusCreated {
+		t.Errorf("expected a delayed message to be accepted, got %d", code)
+	}
+}
+
+func TestOutboundQueueRetriesAndDeadLetters(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	deliveries := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveries++
+		w.WriteHeader(status)
+	}))
+	defer peer.Close()
+
+	sender := newTestBoltAPI(t, "local.dev")
+	worker := federation.NewWorker(sender.DB, federation.NewSender(sender.Domains))
+	worker.Route = func(recipients []string) (map[string][]string, error) {
+		return map[string][]string{peer.URL: recipients}, nil
+	}
+
+	msg := &message.Message{From: "alice#local.dev", To: []string{"carol#remote.dev"}, Body: "hello"}
+	if err := federation.Enqueue(sender.DB, msg, msg.To, ""); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	now := time.Now()
+	worker.ProcessDue(now)
+	items, _ := storage.DueOutboundBolt(sender.DB, now.Add(worker.BaseDelay))
+	if deliveries != 1 || len(items) != 1 || items[0].Attempts != 1 {
+		t.Fatalf("expected one deferred delivery after failure, got %d attempts, %d queued", deliveries, len(items))
+	}
+	worker.ProcessDue(now)
+	if deliveries != 1 {
+		t.Error("delivery retried before its backoff elapsed")
+	}
+
+	status = http.StatusCreated
+	worker.ProcessDue(now.Add(worker.BaseDelay))
+	if items, _ := storage.DueOutboundBolt(sender.DB, now.Add(worker.MaxAge)); deliveries != 2 || len(items) != 0 {
+		t.Fatalf("expected queue drained after success, got %d attempts, %d queued", deliveries, len(items))
+	}
+
+	status = http.StatusBadRequest
+	federation.Enqueue(sender.DB, msg, msg.To, "")
+	worker.ProcessDue(now)
+	if dead, _ := storage.GetDeadLettersBolt(sender.DB); len(dead) != 1 {
+		t.Errorf("expected permanently rejected delivery in dead letters, got %d", len(dead))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if d := federation.Backoff(1, time.Second, time.Minute); d != time.Second {
+		t.Errorf("expected 1s, got %v", d)
+	}
+	if d := federation.Backoff(4, time.Second, time.Minute); d != 8*time.Second {
+		t.Errorf("expected 8s, got %v", d)
+	}
+	if d := federation.Backoff(20, time.Second, time.Minute); d != time.Minute {
+		t.Errorf("expected cap of 1m, got %v", d)
+	}
+}
+
+func TestReceiveFederatedMessageDropsDuplicateDelivery(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	receiver := newTestBoltAPI(t, "remote.dev")
+	receiver.Keys = staticKeys{"alice#local.dev": pub}
+
+	msg := message.Message{From: "alice#local.dev", To: []string{"carol#remote.dev"}, Body: "hello"}
+	msg.Sign(priv)
+	body, _ := json.Marshal(federation.Envelope{Message: msg, Recipients: msg.To, DeliveryID: "d1"})
+
+	for i, want := range []int{http.StatusCreated, http.StatusOK} {
+		w := httptest.NewRecorder()
+		receiver.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+		if w.Code != want {
+			t.Fatalf("delivery %d: expected %d, got %d", i+1, want, w.Code)
+		}
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(receiver.DB, "carol#remote.dev"); len(msgs) != 1 {
+		t.Errorf("expected 1 stored message, got %d", len(msgs))
+	}
+}
+
+func TestPermanentFailureUpdatesStatusAndBounces(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such user", http.StatusNotFound)
+	}))
+	defer peer.Close()
+
+	sender := newTestBoltAPI(t, "local.dev")
+	worker := federation.NewWorker(sender.DB, federation.NewSender(sender.Domains))
+	worker.Route = func(recipients []string) (map[string][]string, error) {
+		return map[string][]string{peer.URL: recipients}, nil
+	}
+
+	msg := &message.Message{From: "alice#local.dev", To: []string{"bob#local.dev", "carol#remote.dev"}, Body: "hello"}
+	msg.AssignID(time.Now())
+	record, err := storage.CreateDeliveryRecordBolt(sender.DB, msg.ID, msg.From, []string{"bob#local.dev"}, []string{"carol#remote.dev"})
+	if err != nil {
+		t.Fatalf("CreateDeliveryRecordBolt failed: %v", err)
+	}
+	federation.Enqueue(sender.DB, msg, []string{"carol#remote.dev"}, record.ID)
+	worker.ProcessDue(time.Now())
+
+	record, _ = storage.GetDeliveryRecordBolt(sender.DB, record.ID)
+	if record.Recipients["bob#local.dev"].State != storage.DeliveryDelivered {
+		t.Errorf("expected local recipient delivered, got %s", record.Recipients["bob#local.dev"].State)
+	}
+	if status := record.Recipients["carol#remote.dev"]; status.State != storage.DeliveryFailed || status.Reason == "" {
+		t.Errorf("expected remote recipient failed with reason, got %+v", status)
+	}
+
+	bounces, _ := storage.GetMessagesByUserBolt(sender.DB, "alice#local.dev")
+	if len(bounces) != 1 || bounces[0].From != system.Address {
+		t.Fatalf("expected one system bounce for alice, got %+v", bounces)
+	}
+
+	// A remote author's relayed post is not bounced into a mailbox here
+	relayed := &message.Message{From: "dave#other.dev", To: []string{"carol#remote.dev"}, Body: "relayed"}
+	relayed.AssignID(time.Now())
+	federation.Enqueue(sender.DB, relayed, []string{"carol#remote.dev"}, "")
+	worker.ProcessDue(time.Now())
+	if msgs, _ := storage.GetMessagesByUserBolt(sender.DB, "dave#other.dev"); len(msgs) != 0 {
+		t.Errorf("expected no bounce for a remote author, got %+v", msgs)
+	}
+}
+
+// routeByDomain routes recipients to the test server registered for their domain
+func routeByDomain(servers map[string]string) func(recipients []string) (map[string][]string, error) {
+	return func(recipients []string) (map[string][]string, error) {
+		routes := make(map[string][]string)
+		for _, recipient := range recipients {
+			server, ok := servers[router.DomainOf(recipient)]
+			if !ok {
+				return nil, fmt.Errorf("no route for %s", recipient)
+			}
+			routes[server] = append(routes[server], recipient)
+		}
+		return routes, nil
+	}
+}
+
+// relaysByDomain confirms relays with the test servers, by the group's domain
+func relaysByDomain(servers map[string]string) *federation.HTTPRelayVerifier {
+	relays := federation.NewRelayVerifier()
+	relays.Server = func(groupID string) (string, error) {
+		if server, ok := servers[router.DomainOf(groupID)]; ok {
+			return server, nil
+		}
+		return "", fmt.Errorf("no server for %s", groupID)
+	}
+	return relays
+}
+
+// startFederation serves the federation endpoints of each API, keyed by domain,
+// and points their relay confirmations at each other
+func startFederation(t *testing.T, apis map[string]*api.BoltAPI) map[string]string {
+	servers := make(map[string]string)
+	for domain, srvAPI := range apis {
+		mux := http.NewServeMux()
+		mux.HandleFunc(federation.InboundPath, srvAPI.ApiReceiveMessage)
+		mux.HandleFunc(federation.RelayPath, srvAPI.ApiConfirmRelay)
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		servers[domain] = srv.URL
+	}
+	for _, srvAPI := range apis {
+		srvAPI.Relays = relaysByDomain(servers)
+	}
+	return servers
+}
+
+func TestGroupPostFromRemoteMemberRelaysThroughHome(t *testing.T) {
+	home := newTestBoltAPI(t, "a.dev")
+	peerB := newTestBoltAPI(t, "b.dev")
+	peerC := newTestBoltAPI(t, "c.dev")
+	servers := startFederation(t, map[string]*api.BoltAPI{"a.dev": home, "b.dev": peerB, "c.dev": peerC})
+	worker := func(srvAPI *api.BoltAPI) *federation.Worker {
+		w := federation.NewWorker(srvAPI.DB, federation.NewSender(srvAPI.Domains))
+		w.Route = routeByDomain(servers)
+		return w
+	}
+
+	bobPriv := registerTestUser(t, peerB, "bob#b.dev")
+	evePriv := registerTestUser(t, peerB, "eve#b.dev")
+	keys := staticKeys{
+		"bob#b.dev": bobPriv.Public().(ed25519.PublicKey),
+		"eve#b.dev": evePriv.Public().(ed25519.PublicKey),
+	}
+	home.Keys, peerC.Keys = keys, keys
+
+	grp := group.NewGroup("team#a.dev", "Team", "", "", []string{"alice#a.dev", "bob#b.dev", "carol#b.dev", "dave#c.dev"})
+	storage.StoreGroupBolt(home.DB, grp)
+
+	post := message.Message{From: "bob#b.dev", GroupID: "team#a.dev", Body: "hello everyone"}
+	post.Sign(bobPriv)
+	if w := sendAs(peerB, "bob#b.dev", &post); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// bob's server hands the post to the home server, which relays it to the
+	// other members' servers, including back to bob's
+	worker(peerB).ProcessDue(time.Now())
+	worker(home).ProcessDue(time.Now())
+
+	for _, tc := range []struct {
+		srvAPI *api.BoltAPI
+		user   string
+	}{
+		{home, "alice#a.dev"},
+		{peerB, "carol#b.dev"},
+		{peerC, "dave#c.dev"},
+	} {
+		msgs, _ := storage.GetMessagesByUserBolt(tc.srvAPI.DB, tc.user)
+		if len(msgs) != 1 || msgs[0].ID != post.ID || msgs[0].GroupID != "team#a.dev" {
+			t.Errorf("expected %s to receive the group post, got %+v", tc.user, msgs)
+		}
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(peerB.DB, "bob#b.dev"); len(msgs) != 0 {
+		t.Errorf("expected the post not to be echoed to its author, got %+v", msgs)
+	}
+
+	// The home server is authoritative: a non-member's post is rejected and bounced
+	intruder := message.Message{From: "eve#b.dev", GroupID: "team#a.dev", Body: "let me in"}
+	intruder.Sign(evePriv)
+	if w := sendAs(peerB, "eve#b.dev", &intruder); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	worker(peerB).ProcessDue(time.Now())
+	if msgs, _ := storage.GetMessagesByUserBolt(home.DB, "alice#a.dev"); len(msgs) != 1 {
+		t.Errorf("expected the non-member's post to be dropped, got %d messages", len(msgs))
+	}
+	bounces, _ := storage.GetMessagesByUserBolt(peerB.DB, "eve#b.dev")
+	if len(bounces) != 1 || bounces[0].From != system.Address {
+		t.Errorf("expected eve to get a bounce, got %+v", bounces)
+	}
+}
+
+func TestConfirmRelayOnlyAnswersTheDestinationPeer(t *testing.T) {
+	home := newTestBoltAPI(t, "a.dev")
+	post := &message.Message{From: "alice#a.dev", GroupID: "team#a.dev", Body: "members only"}
+	storage.StoreMessageBolt(home.DB, post)
+	if err := federation.Enqueue(home.DB, post, []string{"dave#c.dev"}, ""); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	queued, _ := storage.DueOutboundBolt(home.DB, time.Now())
+	if len(queued) != 1 {
+		t.Fatalf("expected one queued delivery, got %d", len(queued))
+	}
+	item := queued[0]
+	digest := federation.RelayDigest(post, []string{"dave#c.dev"})
+
+	for _, tc := range []struct {
+		name, query string
+		want        int
+	}{
+		{"id only", "id=" + item.ID, http.StatusNotFound},
+		{"another domain", "id=" + item.ID + "&domain=b.dev&digest=" + digest, http.StatusNotFound},
+		{"other recipients", "id=" + item.ID + "&domain=c.dev&digest=" + federation.RelayDigest(post, []string{"dave#c.dev", "erin#c.dev"}), http.StatusNotFound},
+		{"destination peer", "id=" + item.ID + "&domain=c.dev&digest=" + digest, http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		home.ApiConfirmRelay(w, httptest.NewRequest("GET", federation.RelayPath+"?"+tc.query, nil))
+		if w.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "members only") {
+			t.Errorf("%s: the confirmation leaks the message: %s", tc.name, w.Body.String())
+		}
+	}
+}
+
+func TestReceiveRejectsUnconfirmedGroupFanOut(t *testing.T) {
+	home := newTestBoltAPI(t, "a.dev")
+	peerC := newTestBoltAPI(t, "c.dev")
+	startFederation(t, map[string]*api.BoltAPI{"a.dev": home, "c.dev": peerC})
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	peerC.Keys = staticKeys{"bob#b.dev": pub}
+
+	// b.dev claims to fan out a group post of a.dev's group; a.dev never sent it
+	post := message.Message{From: "bob#b.dev", GroupID: "team#a.dev", Body: "hello everyone"}
+	post.Sign(priv)
+	body, _ := json.Marshal(federation.Envelope{Message: post, Recipients: []string{"dave#c.dev"}, DeliveryID: "forged"})
+	w := httptest.NewRecorder()
+	peerC.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an unconfirmed fan-out, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReceiveRelaysOnlyGroupsTheMessageAddresses(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	home := newTestBoltAPI(t, "a.dev")
+	home.Keys = staticKeys{"bob#b.dev": pub}
+	storage.StoreGroupBolt(home.DB, group.NewGroup("team#a.dev", "Team", "", "", []string{"alice#a.dev", "bob#b.dev", "dave#c.dev"}))
+
+	direct := message.Message{From: "bob#b.dev", To: []string{"alice#a.dev"}, Body: "just for you"}
+	direct.Sign(priv)
+	inTo := message.Message{From: "bob#b.dev", To: []string{"team#a.dev"}, Body: "to the group's address"}
+	inTo.Sign(priv)
+
+	for name, env := range map[string]federation.Envelope{
+		"1:1 message replayed to the group": {Message: direct, Recipients: []string{"alice#a.dev", "team#a.dev"}},
+		"group only in to":                  {Message: inTo, Recipients: []string{"team#a.dev"}},
+	} {
+		body, _ := json.Marshal(env)
+		w := httptest.NewRecorder()
+		home.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(home.DB, "alice#a.dev"); len(msgs) != 0 {
+		t.Errorf("expected nothing delivered, got %+v", msgs)
+	}
+	if queued, _ := storage.DueOutboundBolt(home.DB, time.Now()); len(queued) != 0 {
+		t.Errorf("expected nothing relayed, got %+v", queued)
+	}
+}
+
+func TestGroupEventsReachKnownRemoteMembers(t *testing.T) {
+	home := newTestBoltAPI(t, "a.dev")
+	peerC := newTestBoltAPI(t, "c.dev")
+	servers := startFederation(t, map[string]*api.BoltAPI{"a.dev": home, "c.dev": peerC})
+	alicePriv := registerTestUser(t, home, "alice#a.dev")
+	peerC.Keys = staticKeys{"alice#a.dev": alicePriv.Public().(ed25519.PublicKey)}
+	worker := federation.NewWorker(home.DB, federation.NewSender(home.Domains))
+	worker.Route = routeByDomain(servers)
+
+	if w := createGroupAs(home, "alice#a.dev", map[string]interface{}{"id": "team#a.dev", "name": "Team", "members": []string{"dave#c.dev"}}); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(home.DB, "dave#c.dev"); len(msgs) != 0 {
+		t.Errorf("expected no local copy for a remote member, got %+v", msgs)
+	}
+
+	// dave's server does not know yet that dave is a member, so it refuses the event
+	worker.ProcessDue(time.Now())
+	if bodies := systemMessages(t, peerC, "dave#c.dev", "team#a.dev"); len(bodies) != 0 {
+		t.Errorf("expected the event for an unknown member to be refused, got %v", bodies)
+	}
+
+	// A confirmed group post shows that dave is a member; later events reach him
+	post := message.Message{From: "alice#a.dev", GroupID: "team#a.dev", Body: "welcome"}
+	post.Sign(alicePriv)
+	if w := sendAs(home, "alice#a.dev", &post); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	worker.ProcessDue(time.Now())
+	groupRequest(home.ApiUpdateGroup, "PATCH", "alice#a.dev", "", map[string]interface{}{"id": "team#a.dev", "name": "Renamed"})
+	worker.ProcessDue(time.Now())
+
+	msgs, _ := storage.GetMessagesByUserBolt(peerC.DB, "dave#c.dev")
+	if len(msgs) != 2 || msgs[0].Body != "welcome" {
+		t.Fatalf("expected the post and the rename event, got %+v", msgs)
+	}
+	if event := msgs[1]; event.From != system.DomainAddress("a.dev") || !strings.Contains(event.Body, group.SystemGroupRenamed) {
+		t.Errorf("expected the rename event from a.dev's system address, got %+v", event)
+	}
+}
+
+func TestReceiveRejectsForgedSystemMessages(t *testing.T) {
+	peerC := newTestBoltAPI(t, "c.dev")
+	evil := newTestBoltAPI(t, "evil.dev")
+	servers := startFederation(t, map[string]*api.BoltAPI{"c.dev": peerC, "evil.dev": evil})
+	worker := federation.NewWorker(evil.DB, federation.NewSender(evil.Domains))
+	worker.Route = routeByDomain(servers)
+
+	// evil.dev queues each forgery itself, so it confirms its own relay
+	for _, from := range []string{system.Address, system.DomainAddress("c.dev"), system.DomainAddress("a.dev"), system.DomainAddress("evil.dev")} {
+		forged := &message.Message{ID: message.NewID(time.Now()), From: from, To: []string{"alice#c.dev"}, GroupID: "anything#evil.dev", Body: "[SYSTEM] your account is suspended", SentAt: time.Now().Unix()}
+		if err := federation.Enqueue(evil.DB, forged, []string{"alice#c.dev"}, ""); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+	worker.ProcessDue(time.Now())
+
+	if msgs, _ := storage.GetMessagesByUserBolt(peerC.DB, "alice#c.dev"); len(msgs) != 0 {
+		t.Errorf("expected every forged system message to be refused, got %+v", msgs)
+	}
+	if dead, _ := storage.GetDeadLettersBolt(evil.DB); len(dead) != 4 {
+		t.Errorf("expected the peer to reject all 4 forgeries, got %d", len(dead))
+	}
+}
+
+func TestReceiveRejectsLocalSenderOutsideRemoteGroup(t *testing.T) {
+	receiver := newTestBoltAPI(t, "b.dev")
+	priv := registerTestUser(t, receiver, "bob#b.dev")
+
+	for _, groupID := range []string{"", "team#b.dev"} {
+		msg := message.Message{From: "bob#b.dev", To: []string{"carol#b.dev"}, GroupID: groupID, Body: "hello"}
+		msg.Sign(priv)
+		body, _ := json.Marshal(federation.Envelope{Message: msg, Recipients: msg.To})
+		w := httptest.NewRecorder()
+		receiver.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("group %q: expected 403 for a local sender, got %d", groupID, w.Code)
+		}
+	}
+}
+
+func TestReceiveExpandsCCdGroupAtHome(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	home := newTestBoltAPI(t, "a.dev")
+	home.Keys = staticKeys{"bob#b.dev": pub}
+	storage.StoreGroupBolt(home.DB, group.NewGroup("ops#a.dev", "Ops", "", "", []string{"alice#a.dev", "bob#b.dev", "dave#c.dev"}))
+
+	msg := message.Message{From: "bob#b.dev", To: []string{"carol#b.dev"}, CC: []string{"ops#a.dev"}, Body: "heads up"}
+	msg.Sign(priv)
+	body, _ := json.Marshal(federation.Envelope{Message: msg, Recipients: []string{"ops#a.dev"}})
+	w := httptest.NewRecorder()
+	home.ApiReceiveMessage(w, httptest.NewRequest("POST", federation.InboundPath, bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if msgs, _ := storage.GetMessagesByUserBolt(home.DB, "alice#a.dev"); len(msgs) != 1 {
+		t.Errorf("expected the local member to receive the message, got %d", len(msgs))
+	}
+	queued, _ := storage.DueOutboundBolt(home.DB, time.Now())
+	if len(queued) != 1 || fmt.Sprint(queued[0].Recipients) != "[dave#c.dev]" {
+		t.Errorf("expected a relay to the remote member only, got %+v", queued)
+	}
+}
@@ -0,0 +1,447 @@
+// group_api_test.go
+// Tests for group endpoints and group system messages stored in BoltDB
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"emsg-daemon/api"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+)
+
+// createGroupAs posts a group to ApiCreateGroup as if authenticated as user
+func createGroupAs(boltAPI *api.BoltAPI, user string, body map[string]interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/api/group", bytes.NewReader(data))
+	req.Header.Set("X-EMSG-User", user)
+	w := httptest.NewRecorder()
+	boltAPI.ApiCreateGroup(w, req)
+	return w
+}
+
+// systemMessages returns the bodies of the system messages in user's mailbox for groupID
+func systemMessages(t *testing.T, boltAPI *api.BoltAPI, user, groupID string) []string {
+	t.Helper()
+	msgs, err := storage.GetMessagesByUserBolt(boltAPI.DB, user)
+	if err != nil {
+		t.Fatalf("GetMessagesByUserBolt failed: %v", err)
+	}
+	var bodies []string
+	for _, msg := range msgs {
+		if system.IsAddress(msg.From) && msg.GroupID == groupID {
+			bodies = append(bodies, msg.Body)
+		}
+	}
+	return bodies
+}
+
+func TestCreateGroupStoresGroupCreatedMessage(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	w := createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{
+		"id": "team#emsg.dev", "name": "Team", "members": []string{"alice#emsg.dev", "bob#emsg.dev"},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, member := range []string{"alice#emsg.dev", "bob#emsg.dev"} {
+		bodies := systemMessages(t, boltAPI, member, "team#emsg.dev")
+		if len(bodies) != 1 || !strings.Contains(bodies[0], group.SystemGroupCreated) {
+			t.Errorf("expected a group created message for %s, got %v", member, bodies)
+		}
+	}
+}
+
+func TestBoltSinkDeliversToMembersAndAffectedUser(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	g := group.NewGroup("team#emsg.dev", "Team", "", "", []string{"alice#emsg.dev", "bob#emsg.dev"})
+	g.Sink = &system.BoltSink{DB: boltAPI.DB}
+
+	if err := g.RemoveMember("bob#emsg.dev"); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	g.UpdateDescription("new")
+
+	if bodies := systemMessages(t, boltAPI, "alice#emsg.dev", "team#emsg.dev"); len(bodies) != 2 {
+		t.Errorf("expected alice to see both events, got %v", bodies)
+	}
+	bodies := systemMessages(t, boltAPI, "bob#emsg.dev", "team#emsg.dev")
+	if len(bodies) != 1 || !strings.Contains(bodies[0], group.SystemUserLeft) {
+		t.Errorf("expected bob to see only his leave event, got %v", bodies)
+	}
+}
+
+// groupRequest calls a group handler as if authenticated as user. body is sent as
+// JSON when not nil; query is appended to the path.
+func groupRequest(handler http.HandlerFunc, method, user, query string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, "/api/group?"+query, bytes.NewReader(data))
+	req.Header.Set("X-EMSG-User", user)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestGetGroupHidesPrivateGroupsFromNonMembers(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "secret#emsg.dev", "name": "Secret", "members": []string{"bob#emsg.dev"}})
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "open#emsg.dev", "name": "Open", "visibility": group.VisibilityPublic})
+
+	for _, tc := range []struct {
+		user, query string
+		want        int
+	}{
+		{"", "id=secret%23emsg.dev", http.StatusNotFound},
+		{"mallory#emsg.dev", "id=secret%23emsg.dev", http.StatusNotFound},
+		{"bob#emsg.dev", "id=secret%23emsg.dev", http.StatusOK},
+		{"", "id=open%23emsg.dev", http.StatusOK},
+	} {
+		w := groupRequest(boltAPI.ApiGetGroup, "GET", tc.user, tc.query, nil)
+		if w.Code != tc.want {
+			t.Errorf("%q %s: expected %d, got %d", tc.user, tc.query, tc.want, w.Code)
+		}
+		if w.Code == http.StatusNotFound && strings.Contains(w.Body.String(), "bob#emsg.dev") {
+			t.Errorf("%q %s: response leaks the member list: %s", tc.user, tc.query, w.Body.String())
+		}
+	}
+
+	// Without a verified auth request, a claimed X-EMSG-User is ignored
+	middleware := &api.AuthMiddleware{DB: boltAPI.DB}
+	w := groupRequest(middleware.OptionalAuth(boltAPI.ApiGetGroup), "GET", "bob#emsg.dev", "id=secret%23emsg.dev", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a spoofed user header to be ignored, got %d", w.Code)
+	}
+}
+
+func TestGroupMembershipEndpoints(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{
+		"id": "team#emsg.dev", "name": "Team", "members": []string{"alice#emsg.dev", "bob#emsg.dev"},
+	})
+
+	steps := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		user    string
+		query   string
+		body    map[string]interface{}
+		want    int
+	}{
+		{"add member", boltAPI.ApiAddGroupMember, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev"}, http.StatusOK},
+		{"add duplicate", boltAPI.ApiAddGroupMember, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev"}, http.StatusConflict},
+		{"unknown group", boltAPI.ApiAddGroupMember, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "nope", "address": "carol#emsg.dev"}, http.StatusNotFound},
+		{"promote member", boltAPI.ApiAddGroupAdmin, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev"}, http.StatusOK},
+		{"promote non-member", boltAPI.ApiAddGroupAdmin, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "dave#emsg.dev"}, http.StatusNotFound},
+		{"rename", boltAPI.ApiUpdateGroup, "PATCH", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "name": "Core Team"}, http.StatusOK},
+		{"empty name", boltAPI.ApiUpdateGroup, "PATCH", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "name": ""}, http.StatusBadRequest},
+		{"remove member", boltAPI.ApiRemoveGroupMember, "DELETE", "alice#emsg.dev", "id=team%23emsg.dev&address=bob%23emsg.dev", nil, http.StatusOK},
+		{"leave", boltAPI.ApiRemoveGroupMember, "DELETE", "carol#emsg.dev", "id=team%23emsg.dev&address=carol%23emsg.dev", nil, http.StatusOK},
+		{"revoke non-admin", boltAPI.ApiRemoveGroupAdmin, "DELETE", "alice#emsg.dev", "id=team%23emsg.dev&address=bob%23emsg.dev", nil, http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if w := groupRequest(step.handler, step.method, step.user, step.query, step.body); w.Code != step.want {
+			t.Fatalf("%s: expected %d, got %d: %s", step.name, step.want, w.Code, w.Body.String())
+		}
+	}
+
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if grp.Name != "Core Team" || len(grp.Members) != 1 || grp.Members[0] != "alice#emsg.dev" {
+		t.Errorf("unexpected stored group %+v", grp)
+	}
+
+	// created, carol joined, carol promoted, renamed, bob removed, carol left
+	if bodies := systemMessages(t, boltAPI, "alice#emsg.dev", "team#emsg.dev"); len(bodies) != 6 {
+		t.Errorf("expected 6 system messages for alice, got %d: %v", len(bodies), bodies)
+	}
+	bobBodies := systemMessages(t, boltAPI, "bob#emsg.dev", "team#emsg.dev")
+	if last := bobBodies[len(bobBodies)-1]; !strings.Contains(last, group.SystemUserRemoved) {
+		t.Errorf("expected bob's last system message to be his removal, got %q", last)
+	}
+}
+
+func TestUpdateGroupBoltRollsBackOnError(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	storage.StoreGroupBolt(boltAPI.DB, group.NewGroup("team#emsg.dev", "Team", "", "", []string{"alice#emsg.dev"}))
+
+	sink := &recordingSink{}
+	_, err := storage.UpdateGroupBolt(boltAPI.DB, "team#emsg.dev", "alice#emsg.dev", sink, func(grp *group.Group) error {
+		grp.AddMember("bob#emsg.dev")
+		return grp.AddMember("alice#emsg.dev")
+	})
+	if err != group.ErrAlreadyMember {
+		t.Fatalf("expected ErrAlreadyMember, got %v", err)
+	}
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if len(grp.Members) != 1 {
+		t.Errorf("expected the failed update not to be saved, got members %v", grp.Members)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("expected no events from a failed update, got %v", sink.events)
+	}
+}
+
+func TestCreateGroupMakesCreatorAdminAndRejectsExistingIDs(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	w := createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{
+		"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if grp.CreatedBy != "alice#emsg.dev" || !grp.IsAdmin("alice#emsg.dev") || !grp.IsMember("alice#emsg.dev") {
+		t.Errorf("expected alice to be creator, admin and member, got %+v", grp)
+	}
+
+	w = createGroupAs(boltAPI, "mallory#emsg.dev", map[string]interface{}{
+		"id": "team#emsg.dev", "name": "Hijacked", "members": []string{"mallory#emsg.dev"},
+	})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an existing group id, got %d", w.Code)
+	}
+	if grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev"); grp.Name != "Team" {
+		t.Errorf("expected the existing group to be untouched, got %+v", grp)
+	}
+}
+
+func TestOnlyGroupAdminsCanMutate(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{
+		"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev", "carol#emsg.dev"},
+	})
+
+	forbidden := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		query   string
+		body    map[string]interface{}
+	}{
+		{"add member", boltAPI.ApiAddGroupMember, "POST", "", map[string]interface{}{"id": "team#emsg.dev", "address": "mallory#emsg.dev"}},
+		{"remove member", boltAPI.ApiRemoveGroupMember, "DELETE", "id=team%23emsg.dev&address=carol%23emsg.dev", nil},
+		{"promote", boltAPI.ApiAddGroupAdmin, "POST", "", map[string]interface{}{"id": "team#emsg.dev", "address": "bob#emsg.dev"}},
+		{"revoke", boltAPI.ApiRemoveGroupAdmin, "DELETE", "id=team%23emsg.dev&address=alice%23emsg.dev", nil},
+		{"rename", boltAPI.ApiUpdateGroup, "PATCH", "", map[string]interface{}{"id": "team#emsg.dev", "name": "Bob's"}},
+	}
+	for _, tc := range forbidden {
+		if w := groupRequest(tc.handler, tc.method, "bob#emsg.dev", tc.query, tc.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s by a member: expected 403, got %d", tc.name, w.Code)
+		}
+	}
+
+	// Members may still leave on their own
+	if w := groupRequest(boltAPI.ApiRemoveGroupMember, "DELETE", "bob#emsg.dev", "id=team%23emsg.dev&address=bob%23emsg.dev", nil); w.Code != http.StatusOK {
+		t.Errorf("expected bob to be able to leave, got %d", w.Code)
+	}
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if grp.IsMember("bob#emsg.dev") || !grp.IsMember("carol#emsg.dev") || grp.Name != "Team" {
+		t.Errorf("unexpected group after forbidden mutations %+v", grp)
+	}
+}
+
+func TestGroupPostPermissionEnforced(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	alicePriv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+	bobPriv := registerTestUser(t, boltAPI, "bob#emsg.dev")
+	w := createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{
+		"id": "news#emsg.dev", "name": "News", "members": []string{"bob#emsg.dev"}, "preset": "announcement",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	post := func(from string, priv []byte) int {
+		msg := message.Message{From: from, To: []string{"alice#emsg.dev", "bob#emsg.dev"}, GroupID: "news#emsg.dev", Body: "hi"}
+		msg.Sign(priv)
+		return sendAs(boltAPI, from, &msg).Code
+	}
+	if code := post("alice#emsg.dev", alicePriv); code != http.StatusCreated {
+		t.Errorf("expected the owner to post in an announcement group, got %d", code)
+	}
+	if code := post("bob#emsg.dev", bobPriv); code != http.StatusForbidden {
+		t.Errorf("expected a member to be refused in an announcement group, got %d", code)
+	}
+
+	// Switching back to the default matrix lets members post again
+	if w := groupRequest(boltAPI.ApiSetGroupPermissions, "PUT", "bob#emsg.dev", "", map[string]interface{}{"id": "news#emsg.dev", "preset": "default"}); w.Code != http.StatusForbidden {
+		t.Errorf("expected a member to be refused changing permissions, got %d", w.Code)
+	}
+	if w := groupRequest(boltAPI.ApiSetGroupPermissions, "PUT", "alice#emsg.dev", "", map[string]interface{}{"id": "news#emsg.dev", "preset": "default"}); w.Code != http.StatusOK {
+		t.Fatalf("expected the owner to change permissions, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := post("bob#emsg.dev", bobPriv); code != http.StatusCreated {
+		t.Errorf("expected a member to post with default permissions, got %d", code)
+	}
+
+	// Read-only members may not post
+	if w := groupRequest(boltAPI.ApiSetGroupRole, "PUT", "alice#emsg.dev", "", map[string]interface{}{"id": "news#emsg.dev", "address": "bob#emsg.dev", "role": "read_only"}); w.Code != http.StatusOK {
+		t.Fatalf("expected role change, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := post("bob#emsg.dev", bobPriv); code != http.StatusForbidden {
+		t.Errorf("expected a read-only member to be refused, got %d", code)
+	}
+}
+
+func TestModeratorsRemoveMembersAndDeleteMessages(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{
+		"id": "team#emsg.dev", "name": "Team", "members": []string{"mod#emsg.dev", "bob#emsg.dev", "carol#emsg.dev", "dave#emsg.dev"},
+	})
+	groupRequest(boltAPI.ApiSetGroupRole, "PUT", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "mod#emsg.dev", "role": "moderator"})
+	groupRequest(boltAPI.ApiSetGroupRole, "PUT", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev", "role": "admin"})
+
+	if w := groupRequest(boltAPI.ApiRemoveGroupMember, "DELETE", "mod#emsg.dev", "id=team%23emsg.dev&address=bob%23emsg.dev", nil); w.Code != http.StatusOK {
+		t.Errorf("expected a moderator to remove a member, got %d", w.Code)
+	}
+	if w := groupRequest(boltAPI.ApiRemoveGroupMember, "DELETE", "mod#emsg.dev", "id=team%23emsg.dev&address=carol%23emsg.dev", nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected a moderator to be refused removing an admin, got %d", w.Code)
+	}
+	if w := groupRequest(boltAPI.ApiSetGroupRole, "PUT", "carol#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "alice#emsg.dev", "role": "member"}); w.Code != http.StatusForbidden {
+		t.Errorf("expected the owner's role to be protected, got %d", w.Code)
+	}
+
+	msg := &message.Message{From: "dave#emsg.dev", To: []string{"alice#emsg.dev"}, GroupID: "team#emsg.dev", Body: "spam"}
+	storage.StoreMessageBolt(boltAPI.DB, msg)
+	deleteAs := func(user string) int {
+		req := httptest.NewRequest("DELETE", "/api/message?id="+msg.ID, nil)
+		req.Header.Set("X-EMSG-User", user)
+		w := httptest.NewRecorder()
+		boltAPI.ApiDeleteMessage(w, req)
+		return w.Code
+	}
+	if code := deleteAs("carol#emsg.dev"); code != http.StatusNoContent {
+		t.Fatalf("expected an admin to delete a group message, got %d", code)
+	}
+	if _, err := storage.GetMessageBolt(boltAPI.DB, msg.ID); err == nil {
+		t.Error("expected the message to be gone")
+	}
+	if code := deleteAs("carol#emsg.dev"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted message, got %d", code)
+	}
+
+	other := &message.Message{From: "dave#emsg.dev", To: []string{"alice#emsg.dev"}, GroupID: "team#emsg.dev", Body: "fine"}
+	storage.StoreMessageBolt(boltAPI.DB, other)
+	req := httptest.NewRequest("DELETE", "/api/message?id="+other.ID, nil)
+	req.Header.Set("X-EMSG-User", "eve#emsg.dev")
+	w := httptest.NewRecorder()
+	boltAPI.ApiDeleteMessage(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a non-member to be refused deleting, got %d", w.Code)
+	}
+}
+
+func TestGroupPostRequiresMembershipAndExpandsMembers(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	alicePriv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+	evePriv := registerTestUser(t, boltAPI, "eve#emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{
+		"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev", "carol#emsg.dev"},
+	})
+
+	post := func(from string, priv []byte, groupID string) *httptest.ResponseRecorder {
+		msg := message.Message{From: from, GroupID: groupID, Body: "standup in 5"}
+		msg.Sign(priv)
+		return sendAs(boltAPI, from, &msg)
+	}
+	if w := post("alice#emsg.dev", alicePriv, "nope"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown group, got %d", w.Code)
+	}
+	if w := post("eve#emsg.dev", evePriv, "team#emsg.dev"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-member, got %d", w.Code)
+	}
+	w := post("alice#emsg.dev", alicePriv, "team#emsg.dev")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Every other member receives the post although the client listed no recipients
+	for _, member := range []string{"bob#emsg.dev", "carol#emsg.dev"} {
+		msgs, _, _ := storage.QueryMessagesBolt(boltAPI.DB, member, storage.MessageQuery{GroupID: "team#emsg.dev", From: "alice#emsg.dev"})
+		if len(msgs) != 1 {
+			t.Errorf("expected %s to receive the group post, got %d messages", member, len(msgs))
+		}
+	}
+	inbox, _, _ := storage.QueryMessagesBolt(boltAPI.DB, "alice#emsg.dev", storage.MessageQuery{Direction: storage.DirectionReceived, From: "alice#emsg.dev"})
+	if len(inbox) != 0 {
+		t.Errorf("expected the sender not to receive their own post, got %d", len(inbox))
+	}
+
+	// Nor can a member slip the post to a non-member through To
+	leak := message.Message{From: "alice#emsg.dev", To: []string{"eve#emsg.dev"}, GroupID: "team#emsg.dev", Body: "psst"}
+	leak.Sign(alicePriv)
+	if w := sendAs(boltAPI, "alice#emsg.dev", &leak); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a non-member in To, got %d", w.Code)
+	}
+	if msgs, _, _ := storage.QueryMessagesBolt(boltAPI.DB, "eve#emsg.dev", storage.MessageQuery{}); len(msgs) != 0 {
+		t.Errorf("expected eve to receive nothing, got %d messages", len(msgs))
+	}
+}
+
+func TestCreateGroupQualifiesIDWithDomain(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev", "alt.dev")
+	registerTestUser(t, boltAPI, "carol#emsg.dev")
+
+	w := createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team", "name": "Team"})
+	var grp group.Group
+	json.NewDecoder(w.Body).Decode(&grp)
+	if w.Code != http.StatusCreated || grp.ID != "team#emsg.dev" {
+		t.Fatalf("expected the bare name to be hosted under the primary domain, got %d %q", w.Code, grp.ID)
+	}
+
+	for _, tc := range []struct {
+		id   string
+		want int
+	}{
+		{"team#alt.dev", http.StatusCreated},
+		{"team#emsg.dev", http.StatusConflict},
+		{"team#elsewhere.dev", http.StatusBadRequest},
+		{"my team", http.StatusBadRequest},
+		{"carol#emsg.dev", http.StatusConflict},
+	} {
+		if w := createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": tc.id, "name": "Team"}); w.Code != tc.want {
+			t.Errorf("create %q: expected %d, got %d: %s", tc.id, tc.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSendExpandsCCGroupsHostedHere(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	alicePriv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+	malloryPriv := registerTestUser(t, boltAPI, "mallory#emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "ops", "name": "Ops", "members": []string{"bob#emsg.dev", "carol#emsg.dev"}})
+
+	msg := message.Message{From: "alice#emsg.dev", To: []string{"dave#emsg.dev"}, CC: []string{"ops#emsg.dev"}, Body: "heads up"}
+	msg.Sign(alicePriv)
+	if w := sendAs(boltAPI, "alice#emsg.dev", &msg); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, user := range []string{"bob#emsg.dev", "carol#emsg.dev", "dave#emsg.dev"} {
+		msgs, _ := storage.GetMessagesByUserBolt(boltAPI.DB, user)
+		if len(msgs) == 0 || msgs[len(msgs)-1].Body != "heads up" {
+			t.Errorf("expected %s to receive the message, got %+v", user, msgs)
+		}
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(boltAPI.DB, "ops#emsg.dev"); len(msgs) != 0 {
+		t.Errorf("expected no mailbox for the group address, got %+v", msgs)
+	}
+	if history, _, _ := groupHistory(t, boltAPI, "bob#emsg.dev", "id=ops%23emsg.dev"); len(history) == 0 || history[0].ID != msg.ID {
+		t.Errorf("expected the CC'd message in the group's history, got %+v", history)
+	}
+
+	spam := message.Message{From: "mallory#emsg.dev", To: []string{"dave#emsg.dev"}, CC: []string{"ops#emsg.dev"}, Body: "buy now"}
+	spam.Sign(malloryPriv)
+	if w := sendAs(boltAPI, "mallory#emsg.dev", &spam); w.Code != http.StatusForbidden {
+		t.Errorf("expected a non-member CC'ing the group to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,107 @@
+// group_audit_test.go
+// Tests for group versioning, the settings audit trail and If-Match updates
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"emsg-daemon/api"
+	"emsg-daemon/internal/storage"
+)
+
+// patchGroupIfMatch sends a PATCH /api/group as user with an optional If-Match header
+func patchGroupIfMatch(boltAPI *api.BoltAPI, user, ifMatch string, body map[string]interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest("PATCH", "/api/group", bytes.NewReader(data))
+	req.Header.Set("X-EMSG-User", user)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	boltAPI.ApiUpdateGroup(w, req)
+	return w
+}
+
+// groupChanges fetches a group's audit trail as user
+func groupChanges(t *testing.T, boltAPI *api.BoltAPI, user, query string) ([]storage.GroupChange, int) {
+	t.Helper()
+	w := groupRequest(boltAPI.ApiGetGroupChanges, "GET", user, query, nil)
+	if w.Code != http.StatusOK {
+		return nil, w.Code
+	}
+	var resp struct {
+		Changes []storage.GroupChange `json:"changes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp.Changes, w.Code
+}
+
+func TestGroupUpdatesRecordAuditTrail(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}})
+
+	patchGroupIfMatch(boltAPI, "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "name": "Core", "description": "Backend"})
+	patchGroupIfMatch(boltAPI, "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "name": "Core"}) // no change
+	groupRequest(boltAPI.ApiSetGroupPermissions, "PUT", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "preset": "announcement"})
+
+	changes, code := groupChanges(t, boltAPI, "bob#emsg.dev", "id=team%23emsg.dev")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %+v", changes)
+	}
+	if c := changes[0]; c.Field != "name" || c.Old != "Team" || c.New != "Core" || c.Actor != "alice#emsg.dev" || c.ChangedAt == 0 {
+		t.Errorf("unexpected first change %+v", c)
+	}
+	if changes[1].Field != "description" || changes[1].Version != changes[0].Version {
+		t.Errorf("expected the description change in the same version, got %+v", changes[1])
+	}
+	if changes[2].Field != "permissions" || changes[2].Version != changes[0].Version+1 {
+		t.Errorf("expected the permissions change in the next version, got %+v", changes[2])
+	}
+
+	later, _ := groupChanges(t, boltAPI, "bob#emsg.dev", "id=team%23emsg.dev&since=1")
+	if len(later) != 1 || later[0].Field != "permissions" {
+		t.Errorf("expected only the permissions change after version 1, got %+v", later)
+	}
+	if _, code := groupChanges(t, boltAPI, "mallory#emsg.dev", "id=team%23emsg.dev"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-member, got %d", code)
+	}
+}
+
+func TestGroupIfMatchRejectsStaleUpdates(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}})
+	groupRequest(boltAPI.ApiAddGroupAdmin, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "bob#emsg.dev"})
+
+	w := groupRequest(boltAPI.ApiGetGroup, "GET", "alice#emsg.dev", "id=team%23emsg.dev", nil)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag on GET /api/group")
+	}
+
+	first := patchGroupIfMatch(boltAPI, "alice#emsg.dev", etag, map[string]interface{}{"id": "team#emsg.dev", "name": "Alice's"})
+	if first.Code != http.StatusOK || first.Header().Get("ETag") == etag {
+		t.Fatalf("expected 200 with a new ETag, got %d %q", first.Code, first.Header().Get("ETag"))
+	}
+	second := patchGroupIfMatch(boltAPI, "bob#emsg.dev", etag, map[string]interface{}{"id": "team#emsg.dev", "name": "Bob's"})
+	if second.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a stale ETag, got %d", second.Code)
+	}
+	retry := patchGroupIfMatch(boltAPI, "bob#emsg.dev", first.Header().Get("ETag"), map[string]interface{}{"id": "team#emsg.dev", "description": "Bob's"})
+	if retry.Code != http.StatusOK {
+		t.Fatalf("expected the retry with the current ETag to succeed, got %d", retry.Code)
+	}
+
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if grp.Name != "Alice's" || grp.Description != "Bob's" {
+		t.Errorf("expected both edits without clobbering, got %q / %q", grp.Name, grp.Description)
+	}
+}
@@ -0,0 +1,116 @@
+// group_history_test.go
+// Tests for group timelines and history visibility for new members
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"emsg-daemon/api"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+)
+
+// groupHistory fetches a page of a group's timeline as user
+func groupHistory(t *testing.T, boltAPI *api.BoltAPI, user, query string) ([]message.Message, string, int) {
+	t.Helper()
+	w := groupRequest(boltAPI.ApiGetGroupMessages, "GET", user, query, nil)
+	if w.Code != http.StatusOK {
+		return nil, "", w.Code
+	}
+	var resp struct {
+		Messages   []message.Message `json:"messages"`
+		NextCursor string            `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp.Messages, resp.NextCursor, w.Code
+}
+
+// storeOldGroupPosts stores n posts by alice in groupID, a second apart, sent over a minute ago
+func storeOldGroupPosts(t *testing.T, boltAPI *api.BoltAPI, groupID string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		sent := time.Now().Add(-time.Minute - time.Duration(n-i)*time.Second)
+		msg := &message.Message{ID: message.NewID(sent), From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, GroupID: groupID, Body: fmt.Sprintf("old %d", i), SentAt: sent.Unix()}
+		if err := storage.StoreMessageBolt(boltAPI.DB, msg); err != nil {
+			t.Fatalf("StoreMessageBolt failed: %v", err)
+		}
+	}
+}
+
+// waitForNextSecond returns once the Unix time has moved on, so that what happens
+// next is recorded as later than what came before
+func waitForNextSecond() {
+	now := time.Now()
+	time.Sleep(now.Truncate(time.Second).Add(time.Second).Sub(now))
+}
+
+func TestGroupTimelinePagination(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}})
+	storeOldGroupPosts(t, boltAPI, "team#emsg.dev", 3)
+	storage.StoreMessageBolt(boltAPI.DB, &message.Message{From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, GroupID: "other#emsg.dev", Body: "elsewhere"})
+
+	var bodies []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		msgs, next, code := groupHistory(t, boltAPI, "bob#emsg.dev", "id=team%23emsg.dev&limit=2&before="+cursor)
+		if code != http.StatusOK || pages > 3 {
+			t.Fatalf("unexpected paging: status %d after %d pages", code, pages)
+		}
+		for _, m := range msgs {
+			bodies = append(bodies, m.Body)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(bodies) != 4 || bodies[1] != "old 2" || bodies[3] != "old 0" {
+		t.Errorf("expected the created event and three posts, newest first, got %v", bodies)
+	}
+
+	if _, _, code := groupHistory(t, boltAPI, "mallory#emsg.dev", "id=team%23emsg.dev"); code != http.StatusForbidden {
+		t.Errorf("expected a non-member to be refused, got %d", code)
+	}
+}
+
+func TestGroupHistoryForNewMembers(t *testing.T) {
+	for _, tc := range []struct {
+		history string
+		want    int // messages carol sees
+	}{
+		{group.HistoryShared, 6},      // two posts, postdated post, joined, new post, late post
+		{group.HistorySinceJoined, 3}, // joined, new post, late post
+	} {
+		boltAPI := newTestBoltAPI(t, "emsg.dev")
+		grp := group.NewGroup("team#emsg.dev", "Team", "", "", []string{"alice#emsg.dev", "bob#emsg.dev"})
+		grp.Admins = []string{"alice#emsg.dev"}
+		grp.History = tc.history
+		storage.StoreGroupBolt(boltAPI.DB, grp)
+		storeOldGroupPosts(t, boltAPI, "team#emsg.dev", 2)
+		// A sent_at in the future does not make an earlier post visible to new members
+		future := time.Now().Add(time.Hour)
+		storage.StoreMessageBolt(boltAPI.DB, &message.Message{ID: message.NewID(future), From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, GroupID: "team#emsg.dev", Body: "postdated", SentAt: future.Unix()})
+		waitForNextSecond()
+
+		groupRequest(boltAPI.ApiAddGroupMember, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev"})
+		storage.StoreMessageBolt(boltAPI.DB, &message.Message{From: "alice#emsg.dev", To: []string{"carol#emsg.dev"}, GroupID: "team#emsg.dev", Body: "welcome"})
+		// Nor does a sent_at in the past hide a post that arrived after they joined
+		past := time.Now().Add(-time.Hour)
+		storage.StoreMessageBolt(boltAPI.DB, &message.Message{ID: message.NewID(past), From: "bob#emsg.dev", To: []string{"carol#emsg.dev"}, GroupID: "team#emsg.dev", Body: "late", SentAt: past.Unix()})
+
+		if msgs, _, _ := groupHistory(t, boltAPI, "carol#emsg.dev", "id=team%23emsg.dev"); len(msgs) != tc.want {
+			t.Errorf("%s: expected carol to see %d messages, got %d", tc.history, tc.want, len(msgs))
+		}
+		if msgs, _, _ := groupHistory(t, boltAPI, "bob#emsg.dev", "id=team%23emsg.dev"); len(msgs) != 6 {
+			t.Errorf("%s: expected an original member to see all 6 messages, got %d", tc.history, len(msgs))
+		}
+	}
+}
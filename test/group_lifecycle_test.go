@@ -0,0 +1,162 @@
+// group_lifecycle_test.go
+// Tests for archiving and deleting groups, ownership transfer and succession
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/storage"
+)
+
+func TestLastAdminLeavingPromotesOldestMember(t *testing.T) {
+	sink := &recordingSink{}
+	g := group.NewGroup("team#emsg.dev", "Team", "", "", []string{"alice#emsg.dev", "bob#emsg.dev", "carol#emsg.dev"})
+	g.SetRole("alice#emsg.dev", group.RoleOwner)
+	g.Sink = sink
+
+	g.RemoveMember("alice#emsg.dev")
+	if g.Owner() != "bob#emsg.dev" || !g.IsAdmin("bob#emsg.dev") {
+		t.Fatalf("expected bob to take over, got owner %q admins %v", g.Owner(), g.Admins)
+	}
+	want := group.SystemOwnershipTransferred + ":bob#emsg.dev"
+	if len(sink.events) != 2 || sink.events[1] != want {
+		t.Errorf("expected %s after the leave event, got %v", want, sink.events)
+	}
+
+	g.RemoveMember("carol#emsg.dev") // not an admin: nothing changes
+	if g.Owner() != "bob#emsg.dev" || len(sink.events) != 3 {
+		t.Errorf("expected no succession for a plain member, got owner %q events %v", g.Owner(), sink.events)
+	}
+}
+
+func TestOwnerLeavingHandsOverToAdmin(t *testing.T) {
+	g := group.NewGroup("team#emsg.dev", "Team", "", "", []string{"alice#emsg.dev", "bob#emsg.dev", "carol#emsg.dev"})
+	g.SetRole("alice#emsg.dev", group.RoleOwner)
+	g.AddAdmin("carol#emsg.dev")
+
+	g.RemoveMember("alice#emsg.dev")
+	if g.Owner() != "carol#emsg.dev" {
+		t.Errorf("expected the remaining admin to become owner, got %q", g.Owner())
+	}
+	if g.IsAdmin("bob#emsg.dev") {
+		t.Error("expected bob to stay a member")
+	}
+}
+
+func TestTransferGroupOwnership(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}})
+
+	for _, tc := range []struct {
+		user, address string
+		want          int
+	}{
+		{"bob#emsg.dev", "bob#emsg.dev", http.StatusForbidden},
+		{"alice#emsg.dev", "carol#emsg.dev", http.StatusNotFound},
+		{"alice#emsg.dev", "bob#emsg.dev", http.StatusOK},
+		{"alice#emsg.dev", "alice#emsg.dev", http.StatusForbidden},
+	} {
+		w := groupRequest(boltAPI.ApiTransferGroupOwnership, "POST", tc.user, "", map[string]interface{}{"id": "team#emsg.dev", "address": tc.address})
+		if w.Code != tc.want {
+			t.Errorf("%s -> %s: expected %d, got %d: %s", tc.user, tc.address, tc.want, w.Code, w.Body.String())
+		}
+	}
+
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if grp.Role("bob#emsg.dev") != group.RoleOwner || grp.Role("alice#emsg.dev") != group.RoleAdmin {
+		t.Errorf("expected bob owner and alice admin, got %q and %q", grp.Role("bob#emsg.dev"), grp.Role("alice#emsg.dev"))
+	}
+}
+
+func TestArchivedGroupIsReadOnly(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}, "visibility": "public"})
+	id := map[string]interface{}{"id": "team#emsg.dev"}
+
+	if w := groupRequest(boltAPI.ApiArchiveGroup, "POST", "bob#emsg.dev", "", id); w.Code != http.StatusForbidden {
+		t.Fatalf("expected a member archiving to be refused, got %d", w.Code)
+	}
+	if w := groupRequest(boltAPI.ApiArchiveGroup, "POST", "alice#emsg.dev", "", id); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	refused := []struct {
+		name    string
+		handler http.HandlerFunc
+		user    string
+		body    map[string]interface{}
+	}{
+		{"add member", boltAPI.ApiAddGroupMember, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev"}},
+		{"join", boltAPI.ApiJoinGroup, "carol#emsg.dev", id},
+		{"rename", boltAPI.ApiUpdateGroup, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Renamed"}},
+		{"invite", boltAPI.ApiCreateInvite, "alice#emsg.dev", id},
+	}
+	for _, step := range refused {
+		if w := groupRequest(step.handler, "POST", step.user, "", step.body); w.Code != http.StatusConflict {
+			t.Errorf("%s: expected 409 while archived, got %d: %s", step.name, w.Code, w.Body.String())
+		}
+	}
+
+	if w := groupRequest(boltAPI.ApiUnarchiveGroup, "DELETE", "alice#emsg.dev", "id=team%23emsg.dev", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := groupRequest(boltAPI.ApiJoinGroup, "POST", "carol#emsg.dev", "", id); w.Code != http.StatusOK {
+		t.Errorf("expected joining to work again, got %d: %s", w.Code, w.Body.String())
+	}
+
+	bodies := systemMessages(t, boltAPI, "bob#emsg.dev", "team#emsg.dev")
+	joined := strings.Join(bodies, "\n")
+	if !strings.Contains(joined, group.SystemGroupArchived) || !strings.Contains(joined, group.SystemGroupUnarchived) {
+		t.Errorf("expected archive and unarchive messages, got %v", bodies)
+	}
+}
+
+func TestDeleteGroupMessagePolicies(t *testing.T) {
+	for _, policy := range []string{"keep", "purge"} {
+		t.Run(policy, func(t *testing.T) {
+			boltAPI := newTestBoltAPI(t, "emsg.dev")
+			createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}})
+			createInvite(t, boltAPI, "alice#emsg.dev", "team#emsg.dev", nil)
+			storeOldGroupPosts(t, boltAPI, "team#emsg.dev", 2)
+
+			query := "id=team%23emsg.dev&messages=" + policy
+			if w := groupRequest(boltAPI.ApiDeleteGroup, "DELETE", "bob#emsg.dev", query, nil); w.Code != http.StatusForbidden {
+				t.Fatalf("expected a member deleting to be refused, got %d", w.Code)
+			}
+			if w := groupRequest(boltAPI.ApiDeleteGroup, "DELETE", "alice#emsg.dev", query, nil); w.Code != http.StatusNoContent {
+				t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if _, err := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev"); err == nil {
+				t.Error("expected the group to be gone")
+			}
+			if invites, _ := storage.ListInvitesBolt(boltAPI.DB, "team#emsg.dev"); len(invites) != 0 {
+				t.Errorf("expected the invites to be gone, got %d", len(invites))
+			}
+
+			msgs, _ := storage.GetMessagesByUserBolt(boltAPI.DB, "bob#emsg.dev")
+			posts, deleted := 0, false
+			for _, m := range msgs {
+				if strings.HasPrefix(m.Body, "old ") {
+					posts++
+				}
+				deleted = deleted || strings.Contains(m.Body, group.SystemGroupDeleted)
+			}
+			if want := map[string]int{"keep": 2, "purge": 0}[policy]; posts != want {
+				t.Errorf("expected %d posts left in bob's mailbox, got %d", want, posts)
+			}
+			if !deleted {
+				t.Error("expected bob to be told the group was deleted")
+			}
+		})
+	}
+
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	w := groupRequest(boltAPI.ApiDeleteGroup, "DELETE", "alice#emsg.dev", "id=team%23emsg.dev&messages=shred", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown policy to be rejected, got %d", w.Code)
+	}
+}
@@ -55,3 +55,95 @@ func TestGroupMetadataAndAdmin(t *testing.T) {
 		t.Error("admin not removed correctly")
 	}
 }
+
+// recordingSink collects the events emitted by group mutations
+type recordingSink struct {
+	events []string
+}
+
+func (s *recordingSink) GroupEvent(g *group.Group, event, user string) {
+	s.events = append(s.events, event+":"+user)
+}
+
+func TestGroupMutationsEmitSystemEvents(t *testing.T) {
+	sink := &recordingSink{}
+	g := group.NewGroup("group1", "Test Group", "desc", "http://img", []string{"alice#emsg.dev"})
+	g.Sink = sink
+
+	g.AddMember("bob#emsg.dev")
+	g.AddMember("bob#emsg.dev") // duplicate, no event
+	g.AddAdmin("alice#emsg.dev")
+	g.UpdateName("Renamed")
+	g.RemoveUserByAdmin("bob#emsg.dev")
+	g.RemoveAdmin("alice#emsg.dev")
+
+	want := []string{
+		group.SystemUserJoined + ":bob#emsg.dev",
+		group.SystemAdminAssigned + ":alice#emsg.dev",
+		group.SystemGroupRenamed + ":",
+		group.SystemUserRemoved + ":bob#emsg.dev",
+		group.SystemAdminRevoked + ":alice#emsg.dev",
+	}
+	if len(sink.events) != len(want) {
+		t.Fatalf("expected events %v, got %v", want, sink.events)
+	}
+	for i := range want {
+		if sink.events[i] != want[i] {
+			t.Errorf("event %d: expected %s, got %s", i, want[i], sink.events[i])
+		}
+	}
+}
+
+func TestGroupRolesAndPermissions(t *testing.T) {
+	g := group.NewGroup("group1", "Test Group", "", "", []string{"owner#emsg.dev", "mod#emsg.dev", "bob#emsg.dev", "ro#emsg.dev"})
+	g.SetRole("owner#emsg.dev", group.RoleOwner)
+	g.SetRole("mod#emsg.dev", group.RoleModerator)
+	g.SetRole("ro#emsg.dev", group.RoleReadOnly)
+
+	roles := map[string]string{
+		"owner#emsg.dev": group.RoleOwner,
+		"mod#emsg.dev":   group.RoleModerator,
+		"bob#emsg.dev":   group.RoleMember,
+		"ro#emsg.dev":    group.RoleReadOnly,
+		"eve#emsg.dev":   "",
+	}
+	for address, want := range roles {
+		if got := g.Role(address); got != want {
+			t.Errorf("Role(%s): expected %q, got %q", address, want, got)
+		}
+	}
+	if !g.IsAdmin("owner#emsg.dev") {
+		t.Error("expected the owner to also be an admin")
+	}
+
+	if !g.Can("bob#emsg.dev", group.PermPost) || g.Can("ro#emsg.dev", group.PermPost) || g.Can("eve#emsg.dev", group.PermPost) {
+		t.Error("default matrix: members post, read-only members and outsiders do not")
+	}
+	if !g.Can("mod#emsg.dev", group.PermRemove) || g.Can("mod#emsg.dev", group.PermEditMetadata) {
+		t.Error("default matrix: moderators remove members but do not edit metadata")
+	}
+
+	announcement, err := group.PresetPermissions(group.PresetAnnouncement)
+	if err != nil {
+		t.Fatalf("PresetPermissions failed: %v", err)
+	}
+	g.UpdatePermissions(announcement)
+	if g.Can("bob#emsg.dev", group.PermPost) || g.Can("mod#emsg.dev", group.PermPost) || !g.Can("owner#emsg.dev", group.PermPost) {
+		t.Error("announcement matrix: only owners and admins post")
+	}
+	if err := g.UpdatePermissions(group.Permissions{"fly": {group.RoleMember}}); err == nil {
+		t.Error("expected an unknown permission to be rejected")
+	}
+
+	// Demoting an admin or leaving clears the role
+	g.SetRole("mod#emsg.dev", group.RoleAdmin)
+	g.SetRole("mod#emsg.dev", group.RoleMember)
+	if g.IsAdmin("mod#emsg.dev") || g.Role("mod#emsg.dev") != group.RoleMember {
+		t.Errorf("expected mod to be a plain member, got %s", g.Role("mod#emsg.dev"))
+	}
+	g.RemoveMember("ro#emsg.dev")
+	g.AddMember("ro#emsg.dev")
+	if g.Role("ro#emsg.dev") != group.RoleMember {
+		t.Errorf("expected a rejoining member to start as member, got %s", g.Role("ro#emsg.dev"))
+	}
+}
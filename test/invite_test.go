@@ -0,0 +1,119 @@
+// invite_test.go
+// Tests for group invite tokens: creation, redemption, expiry and revocation
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"emsg-daemon/api"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/storage"
+)
+
+// createInvite creates an invite for groupID as user and returns it with its token
+func createInvite(t *testing.T, boltAPI *api.BoltAPI, user, groupID string, body map[string]interface{}) storage.Invite {
+	t.Helper()
+	if body == nil {
+		body = map[string]interface{}{}
+	}
+	body["id"] = groupID
+	w := groupRequest(boltAPI.ApiCreateInvite, "POST", user, "", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var inv storage.Invite
+	json.NewDecoder(w.Body).Decode(&inv)
+	if inv.Token == "" {
+		t.Fatal("expected a token in the creation response")
+	}
+	return inv
+}
+
+// redeem joins a group with token as user and returns the status code
+func redeem(boltAPI *api.BoltAPI, user, token string) int {
+	return groupRequest(boltAPI.ApiJoinGroup, "POST", user, "", map[string]interface{}{"token": token}).Code
+}
+
+func TestInviteRedeemSingleUse(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}})
+
+	if w := groupRequest(boltAPI.ApiCreateInvite, "POST", "bob#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev"}); w.Code != http.StatusForbidden {
+		t.Errorf("expected a plain member to be refused, got %d", w.Code)
+	}
+	inv := createInvite(t, boltAPI, "alice#emsg.dev", "team#emsg.dev", nil)
+	if inv.MaxUses != 1 {
+		t.Errorf("expected invites to be single use by default, got %d", inv.MaxUses)
+	}
+
+	if code := redeem(boltAPI, "carol#emsg.dev", inv.Token); code != http.StatusOK {
+		t.Fatalf("expected carol to join, got %d", code)
+	}
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if !grp.IsMember("carol#emsg.dev") {
+		t.Error("expected carol to be a member")
+	}
+	bodies := systemMessages(t, boltAPI, "bob#emsg.dev", "team#emsg.dev")
+	if len(bodies) == 0 || !strings.Contains(bodies[len(bodies)-1], group.SystemUserJoined) {
+		t.Errorf("expected a join event for the members, got %v", bodies)
+	}
+
+	if code := redeem(boltAPI, "dave#emsg.dev", inv.Token); code != http.StatusGone {
+		t.Errorf("expected a used invite to be gone, got %d", code)
+	}
+	if code := redeem(boltAPI, "dave#emsg.dev", "nope"); code != http.StatusBadRequest {
+		t.Errorf("expected a malformed token to be rejected, got %d", code)
+	}
+	forged := inv.ID + "." + strings.Repeat("0", 64)
+	if code := redeem(boltAPI, "dave#emsg.dev", forged); code != http.StatusBadRequest {
+		t.Errorf("expected a forged token to be rejected, got %d", code)
+	}
+}
+
+func TestInviteExpiryRevocationAndListing(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team"})
+
+	unlimited := createInvite(t, boltAPI, "alice#emsg.dev", "team#emsg.dev", map[string]interface{}{"max_uses": 0})
+	for _, user := range []string{"bob#emsg.dev", "carol#emsg.dev"} {
+		if code := redeem(boltAPI, user, unlimited.Token); code != http.StatusOK {
+			t.Errorf("expected %s to join with an unlimited invite, got %d", user, code)
+		}
+	}
+	if code := redeem(boltAPI, "bob#emsg.dev", unlimited.Token); code != http.StatusConflict {
+		t.Errorf("expected a second join to conflict, got %d", code)
+	}
+
+	expired := &storage.Invite{GroupID: "team#emsg.dev", CreatedBy: "alice#emsg.dev", ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+	if err := storage.CreateInviteBolt(boltAPI.DB, expired); err != nil {
+		t.Fatalf("CreateInviteBolt failed: %v", err)
+	}
+	if code := redeem(boltAPI, "dave#emsg.dev", expired.Token); code != http.StatusGone {
+		t.Errorf("expected an expired invite to be gone, got %d", code)
+	}
+
+	if w := groupRequest(boltAPI.ApiRevokeInvite, "DELETE", "alice#emsg.dev", "id=team%23emsg.dev&invite="+unlimited.ID, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := redeem(boltAPI, "dave#emsg.dev", unlimited.Token); code != http.StatusGone {
+		t.Errorf("expected a revoked invite to be gone, got %d", code)
+	}
+
+	w := groupRequest(boltAPI.ApiListInvites, "GET", "alice#emsg.dev", "id=team%23emsg.dev", nil)
+	var list struct {
+		Invites []storage.Invite `json:"invites"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Invites) != 2 {
+		t.Fatalf("expected two invites, got %+v", list.Invites)
+	}
+	for _, inv := range list.Invites {
+		if inv.ID == unlimited.ID && (!inv.Revoked || inv.Uses != 2 || inv.Token != unlimited.Token) {
+			t.Errorf("unexpected listed invite %+v", inv)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// joinrequest_test.go
+// Tests for group visibility, direct joins and the join request approval queue
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/storage"
+)
+
+func TestPublicGroupAllowsDirectJoin(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "lobby#emsg.dev", "name": "Lobby", "visibility": "public"})
+
+	if w := groupRequest(boltAPI.ApiJoinGroup, "POST", "bob#emsg.dev", "", map[string]interface{}{"id": "lobby#emsg.dev"}); w.Code != http.StatusOK {
+		t.Fatalf("expected bob to join, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := groupRequest(boltAPI.ApiJoinGroup, "POST", "bob#emsg.dev", "", map[string]interface{}{"id": "lobby#emsg.dev"}); w.Code != http.StatusConflict {
+		t.Errorf("expected a second join to conflict, got %d", w.Code)
+	}
+	if w := createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "bad", "name": "Bad", "visibility": "secret"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown visibility to be rejected, got %d", w.Code)
+	}
+}
+
+func TestPrivateGroupJoinRequests(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team", "members": []string{"bob#emsg.dev"}})
+
+	for _, user := range []string{"carol#emsg.dev", "dave#emsg.dev", "erin#emsg.dev"} {
+		w := groupRequest(boltAPI.ApiJoinGroup, "POST", user, "", map[string]interface{}{"id": "team#emsg.dev", "note": "hi"})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected a pending request for %s, got %d: %s", user, w.Code, w.Body.String())
+		}
+	}
+	if w := groupRequest(boltAPI.ApiJoinGroup, "POST", "carol#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev"}); w.Code != http.StatusConflict {
+		t.Errorf("expected a duplicate request to conflict, got %d", w.Code)
+	}
+
+	// Only the admin hears about requests
+	if bodies := systemMessages(t, boltAPI, "alice#emsg.dev", "team#emsg.dev"); len(bodies) != 4 || !strings.Contains(bodies[3], group.SystemJoinRequested) {
+		t.Errorf("expected the admin to be notified of each request, got %v", bodies)
+	}
+	for _, user := range []string{"bob#emsg.dev", "carol#emsg.dev"} {
+		for _, body := range systemMessages(t, boltAPI, user, "team#emsg.dev") {
+			if strings.Contains(body, group.SystemJoinRequested) {
+				t.Errorf("expected %s not to see join requests, got %q", user, body)
+			}
+		}
+	}
+
+	if w := groupRequest(boltAPI.ApiListJoinRequests, "GET", "bob#emsg.dev", "id=team%23emsg.dev", nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected a non-admin to be refused the queue, got %d", w.Code)
+	}
+	w := groupRequest(boltAPI.ApiListJoinRequests, "GET", "alice#emsg.dev", "id=team%23emsg.dev", nil)
+	var list struct {
+		Requests []storage.JoinRequest `json:"requests"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Requests) != 3 || list.Requests[0].Note != "hi" {
+		t.Fatalf("expected three pending requests, got %+v", list.Requests)
+	}
+
+	if w := groupRequest(boltAPI.ApiApproveJoinRequest, "POST", "bob#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev"}); w.Code != http.StatusForbidden {
+		t.Errorf("expected a non-admin approval to be refused, got %d", w.Code)
+	}
+	if w := groupRequest(boltAPI.ApiApproveJoinRequest, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "carol#emsg.dev"}); w.Code != http.StatusOK {
+		t.Fatalf("expected approval, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := groupRequest(boltAPI.ApiRejectJoinRequest, "DELETE", "alice#emsg.dev", "id=team%23emsg.dev&address=dave%23emsg.dev", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := groupRequest(boltAPI.ApiRejectJoinRequest, "DELETE", "erin#emsg.dev", "id=team%23emsg.dev&address=erin%23emsg.dev", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected erin to withdraw the request, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := groupRequest(boltAPI.ApiApproveJoinRequest, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "dave#emsg.dev"}); w.Code != http.StatusNotFound {
+		t.Errorf("expected a resolved request to be gone, got %d", w.Code)
+	}
+
+	grp, _ := storage.GetGroupBolt(boltAPI.DB, "team#emsg.dev")
+	if !grp.IsMember("carol#emsg.dev") || grp.IsMember("dave#emsg.dev") || grp.IsMember("erin#emsg.dev") {
+		t.Errorf("unexpected members %v", grp.Members)
+	}
+	if bodies := systemMessages(t, boltAPI, "dave#emsg.dev", "team#emsg.dev"); len(bodies) != 1 || !strings.Contains(bodies[0], group.SystemJoinRejected) {
+		t.Errorf("expected dave to be told of the rejection, got %v", bodies)
+	}
+	if requests, _ := storage.ListJoinRequestsBolt(boltAPI.DB, "team#emsg.dev"); len(requests) != 0 {
+		t.Errorf("expected an empty queue, got %+v", requests)
+	}
+
+	// Nor do join requests and rejections show up in the group's timeline
+	history, _, code := groupHistory(t, boltAPI, "bob#emsg.dev", "id=team%23emsg.dev")
+	if code != http.StatusOK {
+		t.Fatalf("expected bob to read the timeline, got %d", code)
+	}
+	for _, msg := range history {
+		if strings.Contains(msg.Body, group.SystemJoinRequested) || strings.Contains(msg.Body, group.SystemJoinRejected) {
+			t.Errorf("expected the timeline to leave out admin notices, got %q", msg.Body)
+		}
+	}
+}
+
+func TestAddingMemberDropsPendingRequest(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	createGroupAs(boltAPI, "alice#emsg.dev", map[string]interface{}{"id": "team#emsg.dev", "name": "Team"})
+	groupRequest(boltAPI.ApiJoinGroup, "POST", "bob#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev"})
+
+	groupRequest(boltAPI.ApiAddGroupMember, "POST", "alice#emsg.dev", "", map[string]interface{}{"id": "team#emsg.dev", "address": "bob#emsg.dev"})
+	if requests, _ := storage.ListJoinRequestsBolt(boltAPI.DB, "team#emsg.dev"); len(requests) != 0 {
+		t.Errorf("expected bob's request to be dropped once bob joined, got %+v", requests)
+	}
+}
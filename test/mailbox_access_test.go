@@ -0,0 +1,71 @@
+// mailbox_access_test.go
+// Tests that GET /api/messages only serves the authenticated user's mailbox
+package main
+
+import (
+	"emsg-daemon/api"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getMessagesSigned calls ApiGetMessages through RequireAuth with a real signed auth header
+func getMessagesSigned(t *testing.T, boltAPI *api.BoltAPI, address string, priv []byte, query string) int {
+	t.Helper()
+	token, err := api.CreateAuthRequest(address, priv, "GET", "/api/messages")
+	if err != nil {
+		t.Fatalf("CreateAuthRequest failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/api/messages?"+query, nil)
+	req.Header.Set("Authorization", "EMSG "+token)
+	w := httptest.NewRecorder()
+	middleware := &api.AuthMiddleware{DB: boltAPI.DB}
+	middleware.RequireAuth(boltAPI.ApiGetMessages)(w, req)
+	return w.Code
+}
+
+func TestGetMessagesRejectsCrossUserReads(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	alicePriv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+	malloryPriv := registerTestUser(t, boltAPI, "mallory#emsg.dev")
+	storage.StoreMessageBolt(boltAPI.DB, &message.Message{From: "bob#emsg.dev", To: []string{"alice#emsg.dev"}, Body: "private"})
+
+	if code := getMessagesSigned(t, boltAPI, "alice#emsg.dev", alicePriv, "user=alice%23emsg.dev"); code != http.StatusOK {
+		t.Errorf("expected alice to read her own mailbox, got %d", code)
+	}
+	if code := getMessagesSigned(t, boltAPI, "alice#emsg.dev", alicePriv, ""); code != http.StatusOK {
+		t.Errorf("expected mailbox to default to the authenticated user, got %d", code)
+	}
+	if code := getMessagesSigned(t, boltAPI, "mallory#emsg.dev", malloryPriv, "user=alice%23emsg.dev"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for cross-user read, got %d", code)
+	}
+}
+
+func TestGetMessagesSpoofedUserHeaderIsOverridden(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	registerTestUser(t, boltAPI, "alice#emsg.dev")
+	malloryPriv := registerTestUser(t, boltAPI, "mallory#emsg.dev")
+
+	token, _ := api.CreateAuthRequest("mallory#emsg.dev", malloryPriv, "GET", "/api/messages")
+	req := httptest.NewRequest("GET", "/api/messages?user=alice%23emsg.dev", nil)
+	req.Header.Set("Authorization", "EMSG "+token)
+	req.Header.Set("X-EMSG-User", "alice#emsg.dev")
+	w := httptest.NewRecorder()
+	(&api.AuthMiddleware{DB: boltAPI.DB}).RequireAuth(boltAPI.ApiGetMessages)(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 when X-EMSG-User is spoofed, got %d", w.Code)
+	}
+}
+
+func TestGetMessagesAdminOverride(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	registerTestUser(t, boltAPI, "alice#emsg.dev")
+	adminPriv := registerTestUser(t, boltAPI, "postmaster#emsg.dev")
+	boltAPI.Admins = []string{"postmaster#emsg.dev"}
+
+	if code := getMessagesSigned(t, boltAPI, "postmaster#emsg.dev", adminPriv, "user=alice%23emsg.dev"); code != http.StatusOK {
+		t.Errorf("expected admin to read another mailbox, got %d", code)
+	}
+}
@@ -0,0 +1,181 @@
+// message_api_test.go
+// Tests for message submission via the BoltDB REST API
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"emsg-daemon/api"
+	"emsg-daemon/internal/auth"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// registerTestUser stores a user with a fresh key pair and returns the private key
+func registerTestUser(t *testing.T, boltAPI *api.BoltAPI, address string) ed25519.PrivateKey {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	user, err := auth.RegisterUser(address, base64.StdEncoding.EncodeToString(pub), "", "", "", "")
+	if err != nil {
+		t.Fatalf("RegisterUser failed: %v", err)
+	}
+	if err := storage.StoreUserBolt(boltAPI.DB, user); err != nil {
+		t.Fatalf("StoreUserBolt failed: %v", err)
+	}
+	return priv
+}
+
+// sendAs posts msg to ApiSendMessage as if authenticated as user
+func sendAs(boltAPI *api.BoltAPI, user string, msg *message.Message) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(msg)
+	req := httptest.NewRequest("POST", "/api/message", bytes.NewReader(body))
+	req.Header.Set("X-EMSG-User", user)
+	w := httptest.NewRecorder()
+	boltAPI.ApiSendMessage(w, req)
+	return w
+}
+
+func TestSendMessageVerifiesSignature(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	alicePriv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+	malloryPriv := registerTestUser(t, boltAPI, "mallory#emsg.dev")
+
+	signed := message.Message{From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "hello"}
+	signed.Sign(alicePriv)
+
+	cases := []struct {
+		name string
+		user string
+		msg  func() message.Message
+		want int
+	}{
+		{"valid", "alice#emsg.dev", func() message.Message { return signed }, http.StatusCreated},
+		{"spoofed sender", "mallory#emsg.dev", func() message.Message {
+			m := signed
+			m.ID = message.NewID(time.Now())
+			m.Sign(malloryPriv)
+			m.From = "alice#emsg.dev"
+			return m
+		}, http.StatusForbidden},
+		{"unsigned", "alice#emsg.dev", func() message.Message {
+			m := signed
+			m.ID, m.Signature = message.NewID(time.Now()), ""
+			return m
+		}, http.StatusBadRequest},
+		{"tampered", "alice#emsg.dev", func() message.Message {
+			m := signed
+			m.To = []string{"eve#emsg.dev"}
+			return m
+		}, http.StatusUnauthorized},
+		{"wrong key", "alice#emsg.dev", func() message.Message {
+			m := message.Message{From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "hello"}
+			m.Sign(malloryPriv)
+			return m
+		}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		msg := c.msg()
+		if w := sendAs(boltAPI, c.user, &msg); w.Code != c.want {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSendMessageRejectsSkewedTimestamps(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	priv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+
+	signedAt := func(id time.Time, sentAt int64) *message.Message {
+		m := &message.Message{ID: message.NewID(id), SentAt: sentAt, From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "hello"}
+		m.Sign(priv)
+		return m
+	}
+	now := time.Now()
+	cases := []struct {
+		name string
+		msg  *message.Message
+		want int
+	}{
+		{"current", signedAt(now, now.Unix()), http.StatusCreated},
+		{"backdated", signedAt(now.Add(-time.Hour), now.Add(-time.Hour).Unix()), http.StatusBadRequest},
+		{"future-dated", signedAt(now.Add(time.Hour), now.Add(time.Hour).Unix()), http.StatusBadRequest},
+		{"id disagrees with sent_at", signedAt(now.Add(-time.Hour), now.Unix()), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if w := sendAs(boltAPI, "alice#emsg.dev", c.msg); w.Code != c.want {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+// getMessages calls ApiGetMessages with the given query string as if authenticated as user
+func getMessages(t *testing.T, boltAPI *api.BoltAPI, user, query string) ([]message.Message, string, int) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/messages?"+query, nil)
+	req.Header.Set("X-EMSG-User", user)
+	w := httptest.NewRecorder()
+	boltAPI.ApiGetMessages(w, req)
+	if w.Code != http.StatusOK {
+		return nil, "", w.Code
+	}
+	var resp struct {
+		Messages   []message.Message `json:"messages"`
+		NextCursor string            `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp.Messages, resp.NextCursor, w.Code
+}
+
+func TestGetMessagesPaginationAndFilters(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	for i := 0; i < 5; i++ {
+		msg := &message.Message{From: "bob#emsg.dev", To: []string{"alice#emsg.dev"}, Body: fmt.Sprintf("received %d", i)}
+		if i == 4 {
+			msg.GroupID = "team"
+		}
+		storage.StoreMessageBolt(boltAPI.DB, msg)
+	}
+	storage.StoreMessageBolt(boltAPI.DB, &message.Message{From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "sent"})
+
+	var bodies []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		msgs, next, code := getMessages(t, boltAPI, "alice#emsg.dev", "user=alice%23emsg.dev&limit=4&before="+cursor)
+		if code != http.StatusOK || pages > 3 {
+			t.Fatalf("unexpected paging: status %d after %d pages", code, pages)
+		}
+		for _, m := range msgs {
+			bodies = append(bodies, m.Body)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	want := []string{"sent", "received 4", "received 3", "received 2", "received 1", "received 0"}
+	if fmt.Sprint(bodies) != fmt.Sprint(want) {
+		t.Errorf("expected newest-first pages %v, got %v", want, bodies)
+	}
+
+	if msgs, _, _ := getMessages(t, boltAPI, "alice#emsg.dev", "user=alice%23emsg.dev&direction=sent"); len(msgs) != 1 || msgs[0].Body != "sent" {
+		t.Errorf("direction=sent returned %+v", msgs)
+	}
+	if msgs, _, _ := getMessages(t, boltAPI, "alice#emsg.dev", "user=alice%23emsg.dev&direction=received&from=bob%23emsg.dev"); len(msgs) != 5 {
+		t.Errorf("expected 5 received from bob, got %d", len(msgs))
+	}
+	if msgs, _, _ := getMessages(t, boltAPI, "alice#emsg.dev", "user=alice%23emsg.dev&group_id=team"); len(msgs) != 1 {
+		t.Errorf("expected 1 group message, got %d", len(msgs))
+	}
+	if _, _, code := getMessages(t, boltAPI, "alice#emsg.dev", "user=alice%23emsg.dev&limit=zero"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid limit, got %d", code)
+	}
+}
@@ -3,8 +3,13 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"emsg-daemon/internal/group"
 	"emsg-daemon/internal/message"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMessageStruct(t *testing.T) {
@@ -23,3 +28,135 @@ func TestMessageStruct(t *testing.T) {
 		t.Errorf("expected group_id 'group1', got %s", msg.GroupID)
 	}
 }
+
+func TestMessageIDs(t *testing.T) {
+	earlier := message.NewID(time.Unix(1700000000, 0))
+	later := message.NewID(time.Unix(1700000001, 0))
+	if !message.ValidID(earlier) || !message.ValidID(later) {
+		t.Fatalf("generated IDs are not valid: %s, %s", earlier, later)
+	}
+	if !(earlier < later) {
+		t.Errorf("expected IDs to sort by time: %s !< %s", earlier, later)
+	}
+	if message.ValidID("not-an-id") {
+		t.Error("expected malformed ID to be rejected")
+	}
+
+	msg := message.Message{ID: "bogus", From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "hi"}
+	if err := msg.Validate(); err == nil {
+		t.Error("expected Validate to reject malformed client-supplied ID")
+	}
+}
+
+// Published signing test vectors. The key is derived from the seed 0x00, 0x01, ..., 0x1f.
+var signingVectors = []struct {
+	msg       message.Message
+	canonical string
+	signature string
+}{
+	{
+		msg: message.Message{
+			ID:     "17a3f0c2b9e4d1005f3c9a1e7d2b4c68",
+			From:   "alice#example.com",
+			To:     []string{"bob#example.com"},
+			CC:     []string{"carol#example.org"},
+			Body:   "Hello, Bob!",
+			SentAt: 1700000000,
+		},
+		canonical: "15:emsg-message-v1,32:17a3f0c2b9e4d1005f3c9a1e7d2b4c68,10:1700000000,17:alice#example.com,1:1,15:bob#example.com,1:1,17:carol#example.org,0:,11:Hello, Bob!,",
+		signature: "ibqVKwlkq0vegsZTGobfPF9W8/HaM7kQG90yhI0NwJFm2tpm84vcpqGJHqXIZqJRbaVroBWX1FMr8dg4+mVLBg==",
+	},
+	{
+		msg: message.Message{
+			ID:      "17a3f0c2b9e4d1015f3c9a1e7d2b4c69",
+			From:    "alice#example.com",
+			GroupID: "dev-team#example.com",
+			Body:    "multi\nline: 1,2",
+			SentAt:  1700000001,
+		},
+		canonical: "15:emsg-message-v1,32:17a3f0c2b9e4d1015f3c9a1e7d2b4c69,10:1700000001,17:alice#example.com,1:0,1:0,20:dev-team#example.com,15:multi\nline: 1,2,",
+		signature: "5gtwcuMIrwcUUbYVXAtxvWdZld8Nh5yRPbaPez42fqBEFBryq+N4aiwaBx07zMZfDlpsOq87atWmOwXsO9I7DQ==",
+	},
+}
+
+func vectorKey() ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func TestMessageSigningVectors(t *testing.T) {
+	priv := vectorKey()
+	pub := priv.Public().(ed25519.PublicKey)
+	for i, v := range signingVectors {
+		msg := v.msg
+		if got := string(msg.CanonicalBytes()); got != v.canonical {
+			t.Errorf("vector %d: canonical bytes mismatch:\n got  %q\n want %q", i, got, v.canonical)
+		}
+		msg.Sign(priv)
+		if msg.Signature != v.signature {
+			t.Errorf("vector %d: signature mismatch: got %s", i, msg.Signature)
+		}
+		if !msg.Verify(pub) {
+			t.Errorf("vector %d: signature does not verify", i)
+		}
+	}
+}
+
+func TestMessageVerifyDetectsEnvelopeTampering(t *testing.T) {
+	priv := vectorKey()
+	pub := priv.Public().(ed25519.PublicKey)
+	signed := signingVectors[0].msg
+	signed.Sign(priv)
+
+	tampered := []func(m *message.Message){
+		func(m *message.Message) { m.From = "mallory#example.com" },
+		func(m *message.Message) { m.To = []string{"mallory#example.com"} },
+		func(m *message.Message) { m.CC = nil },
+		func(m *message.Message) { m.GroupID = "other-group" },
+		func(m *message.Message) { m.ID = message.NewID(time.Now()) },
+		func(m *message.Message) { m.SentAt++ },
+	}
+	for i, tamper := range tampered {
+		msg := signed
+		tamper(&msg)
+		if msg.Verify(pub) {
+			t.Errorf("tampering %d was not detected", i)
+		}
+	}
+}
+
+func TestDeliverExpandsGroups(t *testing.T) {
+	team := group.NewGroup("team", "Team", "", "", []string{"alice#emsg.dev", "bob#emsg.dev", "carol#emsg.dev"})
+	ops := group.NewGroup("ops", "Ops", "", "", []string{"dave#emsg.dev", "bob#emsg.dev"})
+	groups := map[string]*group.Group{"team": team, "ops": ops}
+
+	msg := &message.Message{From: "alice#emsg.dev", To: []string{"carol#emsg.dev"}, CC: []string{"ops"}, GroupID: "team", Body: "hi"}
+	recipients, err := msg.Deliver(groups)
+	if err != nil {
+		t.Fatalf("Deliver failed: %v", err)
+	}
+	want := []string{"carol#emsg.dev", "dave#emsg.dev", "bob#emsg.dev"}
+	if strings.Join(recipients, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, recipients)
+	}
+
+	// A group post cannot reach non-members through To
+	msg.To = []string{"erin#emsg.dev"}
+	if _, err := msg.Deliver(groups); !errors.Is(err, message.ErrRecipientNotMember) {
+		t.Errorf("expected ErrRecipientNotMember, got %v", err)
+	}
+	msg.To = []string{"carol#emsg.dev"}
+
+	msg.GroupID = "missing"
+	if _, err := msg.Deliver(groups); err != message.ErrUnknownGroup {
+		t.Errorf("expected ErrUnknownGroup, got %v", err)
+	}
+
+	groupOnly := &message.Message{From: "alice#emsg.dev", GroupID: "team", Body: "hi"}
+	if err := groupOnly.Validate(); err != nil {
+		t.Errorf("expected a group message without To to validate, got %v", err)
+	}
+}
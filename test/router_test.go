@@ -2,8 +2,31 @@
 // Tests for DNS TXT-based routing (mocked)
 package main
 
-import "testing"
+import (
+	"testing"
+
+	"emsg-daemon/internal/router"
+)
 
 func TestLookupRoute(t *testing.T) {
 	t.Skip("Skipping DNS lookup test in CI environment.")
 }
+
+func TestValidateGroupID(t *testing.T) {
+	for _, tc := range []struct {
+		id    string
+		valid bool
+	}{
+		{"dev-team#emsg.dev", true},
+		{"Team_2.0#a.example.com", true},
+		{"group1", false},
+		{"#emsg.dev", false},
+		{"team#localhost", false},
+		{"dev team#emsg.dev", false},
+		{"team#a#emsg.dev", false},
+	} {
+		if err := router.ValidateGroupID(tc.id); (err == nil) != tc.valid {
+			t.Errorf("ValidateGroupID(%q) = %v, want valid %v", tc.id, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// sse_test.go
+// Tests for the Server-Sent Events stream and Last-Event-ID resume
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"emsg-daemon/api"
+	"emsg-daemon/internal/events"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+)
+
+// sseEvent is one parsed text/event-stream event
+type sseEvent struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// readSSE parses the next event from the stream, skipping comments
+func readSSE(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event failed: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if ev.Type != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, "id: "):
+			ev.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventsResumeAfterLastEventID(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	boltAPI.StartEvents()
+	alicePriv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+
+	var sent []*message.Message
+	for _, body := range []string{"one", "two", "three"} {
+		msg := &message.Message{From: "bob#emsg.dev", To: []string{"alice#emsg.dev"}, Body: body}
+		if err := storage.StoreMessageBolt(boltAPI.DB, msg); err != nil {
+			t.Fatalf("StoreMessageBolt failed: %v", err)
+		}
+		sent = append(sent, msg)
+	}
+	// A federated message can arrive late with an ID older than the client's cursor
+	late := &message.Message{ID: message.NewID(time.Now().Add(-time.Hour)), From: "carol#remote.dev", To: []string{"alice#emsg.dev"}, Body: "late"}
+	if err := storage.StoreMessageBolt(boltAPI.DB, late); err != nil {
+		t.Fatalf("StoreMessageBolt failed: %v", err)
+	}
+
+	middleware := &api.AuthMiddleware{DB: boltAPI.DB}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.RequireAuth(boltAPI.ApiEvents)(w, api.WithQueryAuth(r))
+	}))
+	defer srv.Close()
+
+	token, _ := api.CreateAuthRequest("alice#emsg.dev", alicePriv, "GET", "/api/events")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/api/events?auth="+url.QueryEscape(token), nil)
+	req.Header.Set("Last-Event-ID", "1") // the inbox sequence number of sent[0]
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	// Exactly the messages that arrived after Last-Event-ID are replayed, in arrival order
+	for i, want := range []*message.Message{sent[1], sent[2], late} {
+		ev := readSSE(t, reader)
+		if ev.ID != fmt.Sprint(i+2) || ev.Type != events.TypeMessage || !strings.Contains(ev.Data, want.ID) {
+			t.Fatalf("expected replay of %s as event %d, got %+v", want.ID, i+2, ev)
+		}
+	}
+
+	live := &message.Message{From: "bob#emsg.dev", To: []string{"alice#emsg.dev"}, Body: "four"}
+	storage.StoreMessageBolt(boltAPI.DB, live)
+	if ev := readSSE(t, reader); ev.ID != "5" || !strings.Contains(ev.Data, `"four"`) {
+		t.Fatalf("expected live message %s as event 5, got %+v", live.ID, ev)
+	}
+
+	// Delivery status changes for alice's own messages are streamed without an id
+	if _, err := storage.CreateDeliveryRecordBolt(boltAPI.DB, "d1", "alice#emsg.dev", nil, []string{"carol#remote.dev"}); err != nil {
+		t.Fatalf("CreateDeliveryRecordBolt failed: %v", err)
+	}
+	storage.UpdateDeliveryStatusBolt(boltAPI.DB, "d1", []string{"carol#remote.dev"}, storage.DeliveryDelivered, "")
+	ev := readSSE(t, reader)
+	if ev.Type != events.TypeDeliveryStatus || ev.ID != "" || !strings.Contains(ev.Data, storage.DeliveryDelivered) {
+		t.Fatalf("expected delivery status event, got %+v", ev)
+	}
+}
@@ -3,8 +3,10 @@
 package main
 
 import (
+	"emsg-daemon/internal/message"
 	"emsg-daemon/internal/storage"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -20,3 +22,57 @@ func TestInitDB(t *testing.T) {
 	}
 	db.Close()
 }
+
+func TestStoreMessageBoltAssignsUniqueIDs(t *testing.T) {
+	db, err := storage.InitBoltDB(filepath.Join(t.TempDir(), "emsg.db"))
+	if err != nil {
+		t.Fatalf("InitBoltDB failed: %v", err)
+	}
+	defer db.Close()
+
+	first := &message.Message{From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "hi!"}
+	second := &message.Message{From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "yo!"}
+	for _, msg := range []*message.Message{first, second} {
+		if err := storage.StoreMessageBolt(db, msg); err != nil {
+			t.Fatalf("StoreMessageBolt failed: %v", err)
+		}
+	}
+	if first.ID == "" || first.ID == second.ID || first.SentAt == 0 {
+		t.Fatalf("expected distinct assigned IDs and a sent timestamp, got %q/%q at %d", first.ID, second.ID, first.SentAt)
+	}
+	if !(first.ID < second.ID) {
+		t.Errorf("expected IDs to sort by creation time: %s !< %s", first.ID, second.ID)
+	}
+
+	msgs, _ := storage.GetMessagesByUserBolt(db, "bob#emsg.dev")
+	if len(msgs) != 2 {
+		t.Errorf("expected both same-length messages to be stored, got %d", len(msgs))
+	}
+
+	dup := &message.Message{ID: first.ID, From: "alice#emsg.dev", To: []string{"bob#emsg.dev"}, Body: "again"}
+	if err := storage.StoreMessageBolt(db, dup); err != storage.ErrMessageExists {
+		t.Errorf("expected ErrMessageExists for reused ID, got %v", err)
+	}
+}
+
+func TestMailboxIndexMatchesExactAddress(t *testing.T) {
+	db, err := storage.InitBoltDB(filepath.Join(t.TempDir(), "emsg.db"))
+	if err != nil {
+		t.Fatalf("InitBoltDB failed: %v", err)
+	}
+	defer db.Close()
+
+	storage.StoreMessageBolt(db, &message.Message{From: "bob#x.com", To: []string{"val#x.com"}, Body: "for val"})
+	storage.StoreMessageBolt(db, &message.Message{From: "bob#x.com", To: []string{"carol#x.com"}, CC: []string{"al#x.com"}, Body: "for al"})
+
+	msgs, err := storage.GetMessagesByUserBolt(db, "al#x.com")
+	if err != nil {
+		t.Fatalf("GetMessagesByUserBolt failed: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Body != "for al" {
+		t.Errorf("expected only al's own message, got %+v", msgs)
+	}
+	if msgs, _ := storage.GetMessagesByUserBolt(db, "nobody#x.com"); len(msgs) != 0 {
+		t.Errorf("expected empty mailbox, got %d messages", len(msgs))
+	}
+}
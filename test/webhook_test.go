@@ -0,0 +1,207 @@
+// webhook_test.go
+// Tests for outgoing webhooks: registration, signing, retries and group events
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"emsg-daemon/api"
+	"emsg-daemon/internal/group"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+	"emsg-daemon/internal/system"
+	"emsg-daemon/internal/webhook"
+
+	"go.etcd.io/bbolt"
+)
+
+// createWebhook registers a webhook for user through the API
+func createWebhook(t *testing.T, boltAPI *api.BoltAPI, user, url string, events ...string) storage.Webhook {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"url": url, "events": events})
+	req := httptest.NewRequest("POST", "/api/webhooks", bytes.NewReader(body))
+	req.Header.Set("X-EMSG-User", user)
+	w := httptest.NewRecorder()
+	boltAPI.ApiCreateWebhook(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var hook storage.Webhook
+	json.NewDecoder(w.Body).Decode(&hook)
+	if hook.Secret == "" {
+		t.Fatal("expected the signing secret in the creation response")
+	}
+	return hook
+}
+
+// testWebhookWorker creates a worker that may reach httptest servers, which
+// listen on loopback and are refused by the default client
+func testWebhookWorker(db *bbolt.DB) *webhook.Worker {
+	worker := webhook.NewWorker(db)
+	worker.Client = &http.Client{Timeout: 10 * time.Second}
+	return worker
+}
+
+// webhookReceiver records signed webhook POSTs, failing the first failures requests
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	failures int
+	payloads []webhook.Payload
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+	if !webhook.Verify(rc.secret, timestamp, body, r.Header.Get(webhook.SignatureHeader)) {
+		rc.t.Errorf("invalid webhook signature %q", r.Header.Get(webhook.SignatureHeader))
+	}
+	if rc.failures > 0 {
+		rc.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var payload webhook.Payload
+	json.Unmarshal(body, &payload)
+	rc.payloads = append(rc.payloads, payload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestWebhookDeliversSignedMessageEventsWithRetry(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	webhook.Register(boltAPI.DB)
+
+	receiver := &webhookReceiver{t: t, failures: 1}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	hook := createWebhook(t, boltAPI, "alice#emsg.dev", srv.URL)
+	receiver.secret = hook.Secret
+
+	storage.StoreMessageBolt(boltAPI.DB, &message.Message{From: "bob#emsg.dev", To: []string{"alice#emsg.dev"}, Body: "ping"})
+
+	worker := testWebhookWorker(boltAPI.DB)
+	now := time.Now()
+	worker.ProcessDue(now)
+	if len(receiver.payloads) != 0 {
+		t.Fatal("expected the first attempt to fail")
+	}
+	worker.ProcessDue(now) // not due yet
+	worker.ProcessDue(now.Add(webhook.DefaultBaseDelay))
+	if len(receiver.payloads) != 1 {
+		t.Fatalf("expected one delivery after retry, got %d", len(receiver.payloads))
+	}
+	if p := receiver.payloads[0]; p.Event != webhook.EventMessage || p.Owner != "alice#emsg.dev" || p.Message.Body != "ping" {
+		t.Errorf("unexpected payload %+v", p)
+	}
+
+	worker.ProcessDue(now.Add(time.Hour))
+	if len(receiver.payloads) != 1 {
+		t.Errorf("expected the delivery to leave the queue, got %d deliveries", len(receiver.payloads))
+	}
+}
+
+func TestWebhookGroupEventsGoToAdmins(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	webhook.Register(boltAPI.DB)
+
+	adminRecv := &webhookReceiver{t: t}
+	memberRecv := &webhookReceiver{t: t}
+	adminSrv := httptest.NewServer(adminRecv)
+	defer adminSrv.Close()
+	memberSrv := httptest.NewServer(memberRecv)
+	defer memberSrv.Close()
+	adminRecv.secret = createWebhook(t, boltAPI, "alice#emsg.dev", adminSrv.URL).Secret
+	memberRecv.secret = createWebhook(t, boltAPI, "bob#emsg.dev", memberSrv.URL, webhook.EventGroup).Secret
+
+	grp := group.NewGroup("team", "Team", "", "", []string{"alice#emsg.dev", "bob#emsg.dev"})
+	grp.Admins = []string{"alice#emsg.dev"}
+	storage.StoreGroupBolt(boltAPI.DB, grp)
+	storage.StoreMessageBolt(boltAPI.DB, &message.Message{
+		From:    system.Address,
+		To:      []string{"alice#emsg.dev", "bob#emsg.dev"},
+		GroupID: "team",
+		Body:    "[SYSTEM] user_joined",
+	})
+
+	testWebhookWorker(boltAPI.DB).ProcessDue(time.Now())
+	if len(adminRecv.payloads) != 1 || adminRecv.payloads[0].Event != webhook.EventGroup || adminRecv.payloads[0].GroupID != "team" {
+		t.Errorf("expected one group event for the admin, got %+v", adminRecv.payloads)
+	}
+	if len(memberRecv.payloads) != 0 {
+		t.Errorf("expected no group event for a non-admin member, got %+v", memberRecv.payloads)
+	}
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "0.0.0.0", "::1", "fe80::1", "fd00::1"} {
+		if err := webhook.CheckAddress(net.ParseIP(addr)); !errors.Is(err, webhook.ErrForbiddenAddress) {
+			t.Errorf("expected %s to be refused, got %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34", "2606:4700::1111"} {
+		if err := webhook.CheckAddress(net.ParseIP(addr)); err != nil {
+			t.Errorf("expected %s to be allowed, got %v", addr, err)
+		}
+	}
+
+	// The default worker never connects to a loopback receiver and drops the delivery
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	webhook.Register(boltAPI.DB)
+	receiver := &webhookReceiver{t: t}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	receiver.secret = createWebhook(t, boltAPI, "alice#emsg.dev", srv.URL).Secret
+	storage.StoreMessageBolt(boltAPI.DB, &message.Message{From: "bob#emsg.dev", To: []string{"alice#emsg.dev"}, Body: "ping"})
+
+	now := time.Now()
+	webhook.NewWorker(boltAPI.DB).ProcessDue(now)
+	if len(receiver.payloads) != 0 {
+		t.Fatalf("expected no delivery to a loopback address, got %+v", receiver.payloads)
+	}
+	if due, _ := storage.DueWebhookDeliveriesBolt(boltAPI.DB, now.Add(time.Hour)); len(due) != 0 {
+		t.Errorf("expected the refused delivery to be dropped, got %+v", due)
+	}
+}
+
+func TestWebhookListAndDelete(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	hook := createWebhook(t, boltAPI, "alice#emsg.dev", "https://hooks.example.com/emsg")
+
+	req := httptest.NewRequest("GET", "/api/webhooks", nil)
+	req.Header.Set("X-EMSG-User", "alice#emsg.dev")
+	w := httptest.NewRecorder()
+	boltAPI.ApiListWebhooks(w, req)
+	var list struct {
+		Webhooks []storage.Webhook `json:"webhooks"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].ID != hook.ID || list.Webhooks[0].Secret != "" {
+		t.Fatalf("expected one webhook without its secret, got %+v", list.Webhooks)
+	}
+
+	for _, tc := range []struct {
+		user string
+		want int
+	}{
+		{"mallory#emsg.dev", http.StatusNotFound},
+		{"alice#emsg.dev", http.StatusNoContent},
+		{"alice#emsg.dev", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest("DELETE", "/api/webhooks?id="+hook.ID, nil)
+		req.Header.Set("X-EMSG-User", tc.user)
+		w := httptest.NewRecorder()
+		boltAPI.ApiDeleteWebhook(w, req)
+		if w.Code != tc.want {
+			t.Errorf("DELETE as %s: expected %d, got %d", tc.user, tc.want, w.Code)
+		}
+	}
+}
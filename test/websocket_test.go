@@ -0,0 +1,131 @@
+// websocket_test.go
+// Tests for real-time message push over WebSocket
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"emsg-daemon/api"
+	"emsg-daemon/internal/events"
+	"emsg-daemon/internal/message"
+	"emsg-daemon/internal/storage"
+)
+
+// dialEventSocket opens /api/ws on srv as address and returns the buffered reader after the handshake
+func dialEventSocket(t *testing.T, srv *httptest.Server, address string, priv []byte) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	token, err := api.CreateAuthRequest(address, priv, "GET", "/api/ws")
+	if err != nil {
+		t.Fatalf("CreateAuthRequest failed: %v", err)
+	}
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "GET /api/ws?auth=%s HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", url.QueryEscape(token))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	// Accept value for the sample nonce from RFC 6455 section 1.3
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", got)
+	}
+	return conn, reader
+}
+
+// readTextFrame reads the next unmasked server text frame, skipping pings
+func readTextFrame(t *testing.T, conn net.Conn, reader *bufio.Reader) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(reader, head[:]); err != nil {
+			t.Fatalf("read frame failed: %v", err)
+		}
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(reader, ext[:])
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(reader, ext[:])
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatalf("read payload failed: %v", err)
+		}
+		if head[0]&0x0F == 0x1 {
+			return payload
+		}
+	}
+}
+
+func TestWebSocketPushesStoredMessages(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	boltAPI.StartEvents()
+	alicePriv := registerTestUser(t, boltAPI, "alice#emsg.dev")
+
+	middleware := &api.AuthMiddleware{DB: boltAPI.DB}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.RequireAuth(boltAPI.ApiWebSocket)(w, api.WithQueryAuth(r))
+	}))
+	defer srv.Close()
+
+	conn, reader := dialEventSocket(t, srv, "alice#emsg.dev", alicePriv)
+
+	// A message for someone else must not reach alice
+	storage.StoreMessageBolt(boltAPI.DB, &message.Message{From: "bob#emsg.dev", To: []string{"carol#emsg.dev"}, Body: "not for alice"})
+	msg := &message.Message{From: "bob#emsg.dev", To: []string{"alice#emsg.dev"}, Body: "hello"}
+	if err := storage.StoreMessageBolt(boltAPI.DB, msg); err != nil {
+		t.Fatalf("StoreMessageBolt failed: %v", err)
+	}
+
+	var ev struct {
+		ID   string          `json:"id"`
+		Type string          `json:"type"`
+		Data message.Message `json:"data"`
+	}
+	if err := json.Unmarshal(readTextFrame(t, conn, reader), &ev); err != nil {
+		t.Fatalf("invalid event: %v", err)
+	}
+	if ev.Type != events.TypeMessage || ev.ID != msg.ID || ev.Data.Body != "hello" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestWebSocketRequiresAuth(t *testing.T) {
+	boltAPI := newTestBoltAPI(t, "emsg.dev")
+	boltAPI.StartEvents()
+
+	req := httptest.NewRequest("GET", "/api/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	w := httptest.NewRecorder()
+	(&api.AuthMiddleware{DB: boltAPI.DB}).RequireAuth(boltAPI.ApiWebSocket)(w, api.WithQueryAuth(req))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", w.Code)
+	}
+}